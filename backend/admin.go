@@ -0,0 +1,28 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// admin.html is a static page that renders counts and recent todos from the
+// list endpoints.
+//
+//go:embed admin.html
+var adminPage []byte
+
+func (t *TodoServer) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(adminPage)
+}
+
+// recomputeCounters rebuilds the cached counters from the database, for
+// when they have drifted from the stored rows.
+func (t *TodoServer) recomputeCounters(w http.ResponseWriter, r *http.Request) {
+	count, err := t.recountTodos()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]int64{"todos": count})
+}
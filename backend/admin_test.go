@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAdminPageIsServed(t *testing.T) {
+	s := newTestServer(t)
+	w := s.do("GET", "/admin", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/html") {
+		t.Errorf("Content-Type = %q, want text/html", contentType)
+	}
+	for _, marker := range []string{`id="pending-count"`, `id="completed-count"`, `id="recent-todos"`, `"/todo-pending"`, `"/todo-completed"`} {
+		if !strings.Contains(w.Body.String(), marker) {
+			t.Errorf("page is missing %s", marker)
+		}
+	}
+}
+
+func TestRecomputeCountsThePrimary(t *testing.T) {
+	replica := newReplica(t, "only on the replica")
+	s := newTestServer(t, func(c *Config) { c.DBReplicaDSN = replica })
+	s.create("first")
+	s.create("second")
+	s.todoCount.count, s.todoCount.valid = 7, true
+
+	w := s.do("POST", "/admin/recompute", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+	var counters map[string]int64
+	decodeData(t, w, &counters)
+	if counters["todos"] != 2 {
+		t.Errorf("todos = %d, want the primary's 2", counters["todos"])
+	}
+	if !s.todoCount.valid || s.todoCount.count != 2 {
+		t.Errorf("cached count = %d (valid %v), want 2", s.todoCount.count, s.todoCount.valid)
+	}
+}
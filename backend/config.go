@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the server settings. Values come from the optional -config
+// YAML file, are overridden by environment variables and finally by
+// command line flags.
+type Config struct {
+	Port         string   `yaml:"port"`
+	DBFile       string   `yaml:"dbFile"`
+	DBReplicaDSN string   `yaml:"dbReplicaDSN"`
+	CORSOrigins  []string `yaml:"corsOrigins"`
+	LogLevel     string   `yaml:"logLevel"`
+	AppTZ        string   `yaml:"appTZ"`
+
+	MaxBodyBytes           int     `yaml:"maxBodyBytes"`
+	MaxDiffBodyBytes       int     `yaml:"maxDiffBodyBytes"`
+	MaxJSONDepth           int     `yaml:"maxJSONDepth"`
+	MaxJSONTokens          int     `yaml:"maxJSONTokens"`
+	MaxDiffJSONTokens      int     `yaml:"maxDiffJSONTokens"`
+	AttentionAgeDays       int     `yaml:"attentionAgeDays"`
+	ErrorRateWindowSeconds int     `yaml:"errorRateWindowSeconds"`
+	ErrorRateThreshold     float64 `yaml:"errorRateThreshold"`
+	QueueWorkers           int     `yaml:"queueWorkers"`
+	QueueCapacity          int     `yaml:"queueCapacity"`
+	DefaultSort            string  `yaml:"defaultSort"`
+	SearchCaseFold         bool    `yaml:"searchCaseFold"`
+	PageTokenSecret        string  `yaml:"pageTokenSecret"`
+	MaxTodos               int     `yaml:"maxTodos"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Port:                   "8000",
+		DBFile:                 "test.db",
+		LogLevel:               "info",
+		AppTZ:                  "Local",
+		MaxBodyBytes:           1 << 20,
+		MaxDiffBodyBytes:       64 << 20,
+		MaxJSONDepth:           20,
+		MaxJSONTokens:          10000,
+		MaxDiffJSONTokens:      2000000,
+		AttentionAgeDays:       14,
+		ErrorRateWindowSeconds: 60,
+		ErrorRateThreshold:     0.1,
+		QueueWorkers:           4,
+		QueueCapacity:          64,
+		SearchCaseFold:         true,
+	}
+}
+
+// loadConfig reads the YAML file at path, if any, on top of the defaults and
+// then applies environment overrides. Unknown keys in the file are errors.
+func loadConfig(path string) (Config, error) {
+	config := defaultConfig()
+	if len(path) > 0 {
+		file, err := os.Open(path)
+		if err != nil {
+			return config, err
+		}
+		defer file.Close()
+		decoder := yaml.NewDecoder(file)
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&config); err != nil && err != io.EOF {
+			return config, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	}
+	config.applyEnv()
+	if len(config.PageTokenSecret) == 0 {
+		// without a configured secret, tokens only survive until a restart
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return config, err
+		}
+		config.PageTokenSecret = string(secret)
+	}
+	return config, nil
+}
+
+func (c *Config) applyEnv() {
+	c.Port = envString("PORT", c.Port)
+	c.DBFile = envString("DB_FILE", c.DBFile)
+	c.DBReplicaDSN = envString("DB_REPLICA_DSN", c.DBReplicaDSN)
+	if origins := os.Getenv("CORS_ORIGINS"); len(origins) > 0 {
+		c.CORSOrigins = strings.Split(origins, ",")
+	}
+	c.LogLevel = envString("LOG_LEVEL", c.LogLevel)
+	c.AppTZ = envString("APP_TZ", c.AppTZ)
+	c.MaxBodyBytes = envInt("MAX_BODY_BYTES", c.MaxBodyBytes)
+	c.MaxDiffBodyBytes = envInt("MAX_DIFF_BODY_BYTES", c.MaxDiffBodyBytes)
+	c.MaxJSONDepth = envInt("MAX_JSON_DEPTH", c.MaxJSONDepth)
+	c.MaxJSONTokens = envInt("MAX_JSON_TOKENS", c.MaxJSONTokens)
+	c.MaxDiffJSONTokens = envInt("MAX_DIFF_JSON_TOKENS", c.MaxDiffJSONTokens)
+	c.AttentionAgeDays = envInt("ATTENTION_AGE_DAYS", c.AttentionAgeDays)
+	c.ErrorRateWindowSeconds = envInt("ERROR_RATE_WINDOW_SECONDS", c.ErrorRateWindowSeconds)
+	c.ErrorRateThreshold = envFloat("ERROR_RATE_THRESHOLD", c.ErrorRateThreshold)
+	c.QueueWorkers = envInt("QUEUE_WORKERS", c.QueueWorkers)
+	c.QueueCapacity = envInt("QUEUE_CAPACITY", c.QueueCapacity)
+	c.DefaultSort = envString("DEFAULT_SORT", c.DefaultSort)
+	c.SearchCaseFold = envBool("SEARCH_CASE_FOLD", c.SearchCaseFold)
+	c.PageTokenSecret = envString("PAGE_TOKEN_SECRET", c.PageTokenSecret)
+	c.MaxTodos = envInt("MAX_TODOS", c.MaxTodos)
+}
+
+// applyFlags copies the flags that were set on the command line, which take
+// precedence over both the config file and the environment.
+func (c *Config) applyFlags(flags *flag.FlagSet) {
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "port" {
+			c.Port = f.Value.String()
+		}
+	})
+}
+
+func (c *Config) validate() error {
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if _, err := time.LoadLocation(c.AppTZ); err != nil {
+		return fmt.Errorf("invalid timezone %q: %w", c.AppTZ, err)
+	}
+	if _, err := parseSort(c.DefaultSort); err != nil {
+		return fmt.Errorf("invalid default sort: %w", err)
+	}
+	if c.QueueWorkers < 1 {
+		return fmt.Errorf("queue workers must be at least 1")
+	}
+	if c.QueueCapacity < 0 {
+		return fmt.Errorf("queue capacity must not be negative")
+	}
+	if c.MaxBodyBytes < 1 || c.MaxDiffBodyBytes < 1 {
+		return fmt.Errorf("body size limits must be positive")
+	}
+	return nil
+}
+
+// envString reads a setting from the environment, using def when the
+// variable is unset.
+func envString(name string, def string) string {
+	if value := os.Getenv(name); len(value) > 0 {
+		return value
+	}
+	return def
+}
+
+// envBool reads a boolean setting from the environment, using def when the
+// variable is unset or invalid.
+func envBool(name string, def bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// envFloat reads a float setting from the environment, using def when the
+// variable is unset or invalid.
+func envFloat(name string, def float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// envInt reads an integer setting from the environment, using def when the
+// variable is unset or invalid.
+func envInt(name string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return value
+}
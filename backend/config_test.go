@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// clearConfigEnv unsets the environment overrides for the test.
+func clearConfigEnv(t *testing.T) {
+	for _, name := range []string{
+		"PORT", "DB_FILE", "DB_REPLICA_DSN", "CORS_ORIGINS", "LOG_LEVEL", "APP_TZ",
+		"MAX_BODY_BYTES", "MAX_DIFF_BODY_BYTES", "MAX_JSON_DEPTH", "MAX_JSON_TOKENS", "MAX_DIFF_JSON_TOKENS", "ATTENTION_AGE_DAYS", "ERROR_RATE_WINDOW_SECONDS",
+		"ERROR_RATE_THRESHOLD", "QUEUE_WORKERS", "QUEUE_CAPACITY", "DEFAULT_SORT",
+		"SEARCH_CASE_FOLD", "PAGE_TOKEN_SECRET", "MAX_TODOS",
+	} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfigFile(t, `
+port: "8100"
+dbFile: file.db
+corsOrigins: ["http://localhost:3000"]
+logLevel: debug
+maxTodos: 50
+pageTokenSecret: from-file
+`)
+	t.Setenv("DB_FILE", "env.db")
+	t.Setenv("MAX_TODOS", "75")
+	t.Setenv("PORT", "8200")
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := flag.NewFlagSet("todo", flag.ContinueOnError)
+	flags.String("port", "8000", "")
+	if err := flags.Parse([]string{"-port", "8300"}); err != nil {
+		t.Fatal(err)
+	}
+	config.applyFlags(flags)
+
+	want := defaultConfig()
+	want.Port = "8300"
+	want.DBFile = "env.db"
+	want.CORSOrigins = []string{"http://localhost:3000"}
+	want.LogLevel = "debug"
+	want.MaxTodos = 75
+	want.PageTokenSecret = "from-file"
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("config = %+v\nwant     %+v", config, want)
+	}
+}
+
+func TestLoadConfigWithoutFile(t *testing.T) {
+	clearConfigEnv(t)
+	config, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Port != "8000" || config.DBFile != "test.db" || len(config.PageTokenSecret) == 0 {
+		t.Errorf("config = %+v, want the defaults with a generated page token secret", config)
+	}
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	path := writeConfigFile(t, "port: \"8100\"\ndatabase: todo.db\n")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "database") {
+		t.Errorf("error = %v, want one naming the unknown key", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+	}{
+		{"log level", func(c *Config) { c.LogLevel = "loud" }},
+		{"timezone", func(c *Config) { c.AppTZ = "Mars/Olympus" }},
+		{"default sort", func(c *Config) { c.DefaultSort = "priority" }},
+		{"body size", func(c *Config) { c.MaxBodyBytes = 0 }},
+		{"no queue workers", func(c *Config) { c.QueueWorkers = 0 }},
+		{"negative queue capacity", func(c *Config) { c.QueueCapacity = -1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := defaultConfig()
+			tt.modify(&config)
+			if err := config.validate(); err == nil {
+				t.Error("invalid config was accepted")
+			}
+		})
+	}
+}
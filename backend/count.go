@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"gorm.io/plugin/dbresolver"
+)
+
+// errTodoLimit is returned by queries that would take the number of todos
+// past MAX_TODOS.
+var errTodoLimit = errors.New("todo limit reached")
+
+// todoCounter caches the number of non-deleted todos so the MAX_TODOS check
+// doesn't count rows on every create. It is loaded on first use and then
+// kept current by the queries that add or remove todos.
+type todoCounter struct {
+	mu    sync.Mutex
+	count int64
+	valid bool
+}
+
+func (t *TodoServer) countTodos() (int64, error) {
+	t.todoCount.mu.Lock()
+	defer t.todoCount.mu.Unlock()
+	return t.loadTodoCount()
+}
+
+// loadTodoCount returns the cached count, counting the table first when it
+// isn't loaded. The caller holds the lock.
+func (t *TodoServer) loadTodoCount() (int64, error) {
+	if !t.todoCount.valid {
+		// counted on the primary, a lagging replica would let creates
+		// through past MAX_TODOS
+		if err := t.db.Clauses(dbresolver.Write).Model(&Todo{}).Count(&t.todoCount.count).Error; err != nil {
+			return 0, err
+		}
+		t.todoCount.valid = true
+	}
+	return t.todoCount.count, nil
+}
+
+// changeTodoCount runs a query that adds or removes todos and applies the
+// change in rows it reports to the cached count. Before adding rows the
+// query calls reserve with how many it adds, which fails with errTodoLimit
+// when they don't fit within MAX_TODOS. The lock is held throughout, so
+// concurrent requests can't both pass the limit or count the same rows
+// twice.
+func (t *TodoServer) changeTodoCount(query func(reserve func(n int64) error) (int64, error)) error {
+	t.todoCount.mu.Lock()
+	defer t.todoCount.mu.Unlock()
+	if t.maxTodos > 0 {
+		// loaded up front, as the query may hold the only connection in a
+		// transaction while it reserves
+		if _, err := t.loadTodoCount(); err != nil {
+			return err
+		}
+	}
+	reserve := func(n int64) error {
+		if t.maxTodos > 0 && t.todoCount.count+n > int64(t.maxTodos) {
+			return errTodoLimit
+		}
+		return nil
+	}
+	delta, err := query(reserve)
+	if err != nil {
+		return err
+	}
+	if t.todoCount.valid {
+		t.todoCount.count += delta
+	}
+	return nil
+}
+
+// todoLimitMessage is the response to a request failing with errTodoLimit.
+func (t *TodoServer) todoLimitMessage() string {
+	return fmt.Sprintf("todo limit of %d reached, delete some todos first", t.maxTodos)
+}
+
+// recountTodos recomputes the cached count from the primary. The cache is
+// left invalid if the count fails, so the next check retries it.
+func (t *TodoServer) recountTodos() (int64, error) {
+	t.todoCount.mu.Lock()
+	defer t.todoCount.mu.Unlock()
+	t.todoCount.valid = false
+	var count int64
+	if err := t.db.Clauses(dbresolver.Write).Model(&Todo{}).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	t.todoCount.count, t.todoCount.valid = count, true
+	return count, nil
+}
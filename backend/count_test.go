@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+// countQueries counts the COUNT(*) statements the server runs from now on.
+func countQueries(t *testing.T, s *testServer) *int {
+	t.Helper()
+	n := 0
+	err := s.db.Callback().Query().After("gorm:query").Register("test:count_queries", func(tx *gorm.DB) {
+		if strings.Contains(strings.ToLower(tx.Statement.SQL.String()), "count(*)") {
+			n++
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &n
+}
+
+// checkCachedCount fails when the cached count differs from the table.
+func checkCachedCount(t *testing.T, s *testServer) {
+	t.Helper()
+	s.todoCount.mu.Lock()
+	cached, valid := s.todoCount.count, s.todoCount.valid
+	s.todoCount.mu.Unlock()
+	var stored int64
+	s.db.Model(&Todo{}).Count(&stored)
+	if valid && cached != stored {
+		t.Errorf("cached count = %d, table holds %d", cached, stored)
+	}
+}
+
+func TestTodoLimitAtAndOverCap(t *testing.T) {
+	s := newTestServer(t, func(c *Config) { c.MaxTodos = 2 })
+	first := s.create("first")
+	s.create("second")
+	checkCachedCount(t, s)
+
+	w := s.do("PUT", "/todo", `{"description":"third"}`)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "todo limit of 2 reached") {
+		t.Errorf("create over the cap: status %d %q, want 403 naming the limit", w.Code, w.Body)
+	}
+	if w := s.do("POST", "/todos/import?format=text", "third"); w.Code != http.StatusForbidden {
+		t.Errorf("import over the cap: status %d, want 403", w.Code)
+	}
+
+	s.do("DELETE", fmt.Sprintf("/todo/%d", first.ID), "")
+	checkCachedCount(t, s)
+	if w := s.do("POST", "/todos/import?format=text", "third\nfourth"); w.Code != http.StatusForbidden {
+		t.Errorf("import of 2 with room for 1: status %d, want 403", w.Code)
+	}
+	if w := s.do("PUT", "/todo", `{"description":"third"}`); w.Code != http.StatusOK {
+		t.Errorf("create back at the cap: status %d, want 200: %s", w.Code, w.Body)
+	}
+	checkCachedCount(t, s)
+}
+
+func TestTodoLimitAllowsUpsertUpdates(t *testing.T) {
+	s := newTestServer(t, func(c *Config) { c.MaxTodos = 2 })
+	s.create("first")
+	if w := s.do("PUT", "/todo", `{"publicId":"client-1","description":"second"}`); w.Code != http.StatusOK {
+		t.Fatalf("upsert insert: status %d: %s", w.Code, w.Body)
+	}
+
+	if w := s.do("PUT", "/todo", `{"publicId":"client-1","description":"second, edited"}`); w.Code != http.StatusOK {
+		t.Errorf("upsert update at the cap: status %d, want 200: %s", w.Code, w.Body)
+	}
+	if w := s.do("PUT", "/todo", `{"publicId":"client-2","description":"third"}`); w.Code != http.StatusForbidden {
+		t.Errorf("upsert insert over the cap: status %d, want 403", w.Code)
+	}
+	checkCachedCount(t, s)
+}
+
+func TestTodoLimitAppliesToRestore(t *testing.T) {
+	s := newTestServer(t, func(c *Config) { c.MaxTodos = 2 })
+	first := s.create("first")
+	second := s.create("second")
+	s.do("DELETE", fmt.Sprintf("/todo/%d", first.ID), "")
+	s.do("DELETE", fmt.Sprintf("/todo/%d", second.ID), "")
+	s.create("third")
+
+	body := fmt.Sprintf(`{"ids":[%d,%d]}`, first.ID, second.ID)
+	if w := s.do("POST", "/todos/restore", body); w.Code != http.StatusForbidden {
+		t.Errorf("restoring 2 with room for 1: status %d, want 403", w.Code)
+	}
+	if w := s.do("POST", "/todos/restore", fmt.Sprintf(`{"ids":[%d]}`, first.ID)); w.Code != http.StatusOK {
+		t.Errorf("restoring 1 with room for 1: status %d, want 200: %s", w.Code, w.Body)
+	}
+	checkCachedCount(t, s)
+}
+
+func TestTodoCountIsCached(t *testing.T) {
+	s := newTestServer(t, func(c *Config) { c.MaxTodos = 100 })
+	counts := countQueries(t, s)
+	source := s.create("first")
+	target := s.create("second")
+	s.do("PUT", "/todo", `{"publicId":"client-1","description":"third"}`)
+	s.do("POST", "/todos/import?format=text", "fourth\nfifth")
+	s.do("DELETE", fmt.Sprintf("/todo/%d", source.ID), "")
+	s.do("POST", "/todos/restore", fmt.Sprintf(`{"ids":[%d]}`, source.ID))
+	s.do("POST", "/todos/merge", fmt.Sprintf(`{"sourceId":%d,"targetId":%d}`, source.ID, target.ID))
+	s.create("sixth")
+
+	// one load of the cache; the others are the publicId lookup of the
+	// upsert and the deleted-row count of the restore
+	if *counts != 3 {
+		t.Errorf("%d COUNT queries, want 3", *counts)
+	}
+	checkCachedCount(t, s)
+	if count, _ := s.countTodos(); count != 5 {
+		t.Errorf("cached count = %d, want 5", count)
+	}
+}
+
+func TestTodoLimitUnderConcurrency(t *testing.T) {
+	s := newTestServer(t, func(c *Config) { c.MaxTodos = 5 })
+	first := s.create("first")
+	s.do("DELETE", fmt.Sprintf("/todo/%d", first.ID), "")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			switch i % 4 {
+			case 0:
+				s.do("PUT", "/todo", fmt.Sprintf(`{"publicId":"client-%d","description":"upsert %d"}`, i, i))
+			case 1:
+				s.do("POST", "/todos/import?format=text", fmt.Sprintf("import %d", i))
+			case 2:
+				s.do("POST", "/todos/restore", fmt.Sprintf(`{"ids":[%d]}`, first.ID))
+			default:
+				s.do("PUT", "/todo", fmt.Sprintf(`{"description":"create %d"}`, i))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var stored int64
+	s.db.Model(&Todo{}).Count(&stored)
+	if stored != 5 {
+		t.Errorf("%d todos stored, want exactly MAX_TODOS=5", stored)
+	}
+	checkCachedCount(t, s)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "{", `\{`, "}", `\}`,
+	"[", `\[`, "]", `\]`, "(", `\(`, ")", `\)`, "#", `\#`, "+", `\+`,
+	"-", `\-`, ".", `\.`, "!", `\!`, "|", `\|`, "<", `\<`, ">", `\>`,
+	"\r", "", "\n", " ",
+)
+
+func (t *TodoServer) exportTodos(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "markdown" {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("unsupported format: %s", format))
+		return
+	}
+	sort, err := t.sortParam(r.URL.Query())
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	todos, err := t.listTodosQuery(todoFilter{}, sort, 0, 0)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if format != "markdown" {
+		// backups are a file format fed back into the snapshot diff, so
+		// they stay bare regardless of api version
+		t.localize(todos)
+		writeRawJSON(w, r, http.StatusOK, todos)
+		return
+	}
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	w.Write([]byte(markdownChecklist(todos)))
+}
+
+// markdownChecklist renders todos as a checklist with pending items first
+// and deferred ones in a section of their own.
+func markdownChecklist(todos []Todo) string {
+	var pending, deferred, completed strings.Builder
+	for _, todo := range todos {
+		description := markdownEscaper.Replace(todo.Description)
+		switch {
+		case todo.Completed:
+			fmt.Fprintf(&completed, "- [x] %s\n", description)
+		case todo.Deferred:
+			fmt.Fprintf(&deferred, "- [ ] %s\n", description)
+		default:
+			fmt.Fprintf(&pending, "- [ ] %s\n", description)
+		}
+	}
+	checklist := "## Pending\n\n" + pending.String()
+	if deferred.Len() > 0 {
+		checklist += "\n## Deferred\n\n" + deferred.String()
+	}
+	return checklist + "\n## Completed\n\n" + completed.String()
+}
+
+// SnapshotDiffRequest holds two todo snapshots as produced by
+// GET /todos/export.
+type SnapshotDiffRequest struct {
+	Before []Todo `json:"before"`
+	After  []Todo `json:"after"`
+}
+
+type SnapshotDiff struct {
+	Added   []uint `json:"added"`
+	Removed []uint `json:"removed"`
+	Changed []uint `json:"changed"`
+}
+
+// diffSnapshots compares two snapshots by todo id. A todo counts as changed
+// when its content, state or last update time differ.
+func diffSnapshots(before, after []Todo) SnapshotDiff {
+	diff := SnapshotDiff{Added: []uint{}, Removed: []uint{}, Changed: []uint{}}
+	previous := make(map[uint]Todo, len(before))
+	for _, todo := range before {
+		previous[todo.ID] = todo
+	}
+	for _, todo := range after {
+		old, ok := previous[todo.ID]
+		delete(previous, todo.ID)
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, todo.ID)
+		case old.Description != todo.Description || old.Completed != todo.Completed ||
+			old.Deferred != todo.Deferred || !old.UpdatedAt.Equal(todo.UpdatedAt):
+			diff.Changed = append(diff.Changed, todo.ID)
+		}
+	}
+	for id := range previous {
+		diff.Removed = append(diff.Removed, id)
+	}
+	for _, ids := range [][]uint{diff.Added, diff.Removed, diff.Changed} {
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	}
+	return diff
+}
+
+// diffBackups compares two snapshots. Whole snapshots run far past
+// MAX_BODY_BYTES and MAX_JSON_TOKENS, so the body is held to
+// MAX_DIFF_BODY_BYTES and MAX_DIFF_JSON_TOKENS instead.
+func (t *TodoServer) diffBackups(w http.ResponseWriter, r *http.Request) {
+	var diffRequest SnapshotDiffRequest
+	if err := decodeJSONWithin(w, r, &diffRequest, t.maxDiffBodyBytes, t.maxJSONDepth, t.maxDiffJSONTokens); err != nil {
+		writeError(w, r, bodyErrorStatus(err), err.Error())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, diffSnapshots(diffRequest.Before, diffRequest.After))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMarkdownExport(t *testing.T) {
+	s := newTestServer(t)
+	s.create("buy milk")
+	done := s.create("call mom")
+	s.create("fix *bold* [link](x) #1")
+	s.do("POST", fmt.Sprintf("/todo/%d", done.ID), "")
+
+	w := s.do("GET", "/todos/export?format=markdown", "")
+	if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/markdown") {
+		t.Errorf("Content-Type = %q, want text/markdown", contentType)
+	}
+	want := "## Pending\n\n" +
+		"- [ ] buy milk\n" +
+		"- [ ] fix \\*bold\\* \\[link\\]\\(x\\) \\#1\n" +
+		"\n## Completed\n\n" +
+		"- [x] call mom\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("export =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestMarkdownEscapesLineBreaks(t *testing.T) {
+	got := markdownChecklist([]Todo{{Description: "line one\r\n- [x] line two"}})
+	if want := "- [ ] line one \\- \\[x\\] line two\n"; !strings.Contains(got, want) {
+		t.Errorf("checklist = %q, want it to contain %q", got, want)
+	}
+}
+
+func TestMarkdownExportListsDeferredSeparately(t *testing.T) {
+	s := newTestServer(t)
+	s.create("buy milk")
+	someday := s.create("learn the cello")
+	s.do("POST", fmt.Sprintf("/todo/%d/defer", someday.ID), "")
+
+	want := "## Pending\n\n- [ ] buy milk\n\n## Deferred\n\n- [ ] learn the cello\n\n## Completed\n\n"
+	if got := s.do("GET", "/todos/export?format=markdown", "").Body.String(); got != want {
+		t.Errorf("export =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	s := newTestServer(t)
+	for _, description := range []string{"unchanged", "edited", "completed", "removed"} {
+		s.create(description)
+	}
+	before := s.do("GET", "/todos/export", "").Body.String()
+
+	s.db.Model(&Todo{}).Where("id = ?", 2).Update("description", "edited again")
+	s.do("POST", "/todo/3", "")
+	s.do("DELETE", "/todo/4", "")
+	s.create("added")
+	after := s.do("GET", "/todos/export", "").Body.String()
+
+	w := s.do("POST", "/admin/backup/diff", `{"before":`+before+`,"after":`+after+`}`)
+	var diff SnapshotDiff
+	decodeData(t, w, &diff)
+	want := SnapshotDiff{Added: []uint{5}, Removed: []uint{4}, Changed: []uint{2, 3}}
+	if fmt.Sprint(diff) != fmt.Sprint(want) {
+		t.Errorf("diff = %+v, want %+v", diff, want)
+	}
+}
+
+func TestDiffSnapshotsAcceptsLargeSnapshots(t *testing.T) {
+	s := newTestServer(t)
+	snapshot := make([]Todo, 500)
+	for i := range snapshot {
+		snapshot[i] = Todo{Description: fmt.Sprintf("todo %d", i)}
+		snapshot[i].ID = uint(i + 1)
+	}
+	body := jsonBody(t, SnapshotDiffRequest{Before: snapshot, After: snapshot[:250]})
+	if checkJSONLimits([]byte(body), s.maxJSONDepth, s.maxJSONTokens) == nil {
+		t.Fatal("body is too small to exceed MAX_JSON_TOKENS")
+	}
+	w := s.do("POST", "/admin/backup/diff", body)
+	var diff SnapshotDiff
+	decodeData(t, w, &diff)
+	if w.Code != http.StatusOK || len(diff.Removed) != 250 {
+		t.Errorf("status %d with %d removed, want 200 with 250: %.200s", w.Code, len(diff.Removed), w.Body)
+	}
+
+	small := newTestServer(t, func(c *Config) { c.MaxDiffJSONTokens = 100 })
+	if w := small.do("POST", "/admin/backup/diff", body); w.Code != http.StatusBadRequest {
+		t.Errorf("over MAX_DIFF_JSON_TOKENS: status %d, want 400", w.Code)
+	}
+	tight := newTestServer(t, func(c *Config) { c.MaxDiffBodyBytes = 1024 })
+	if w := tight.do("POST", "/admin/backup/diff", body); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("over MAX_DIFF_BODY_BYTES: status %d, want 413", w.Code)
+	}
+}
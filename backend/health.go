@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errorRateTracker counts requests and 5xx responses in one-second buckets
+// over a rolling window.
+type errorRateTracker struct {
+	mu      sync.Mutex
+	buckets []errorRateBucket
+}
+
+type errorRateBucket struct {
+	second int64
+	total  int
+	failed int
+}
+
+func newErrorRateTracker(window time.Duration) *errorRateTracker {
+	seconds := int(window / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return &errorRateTracker{buckets: make([]errorRateBucket, seconds)}
+}
+
+func (e *errorRateTracker) record(failed bool) {
+	now := time.Now().Unix()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	bucket := &e.buckets[now%int64(len(e.buckets))]
+	if bucket.second != now {
+		*bucket = errorRateBucket{second: now}
+	}
+	bucket.total++
+	if failed {
+		bucket.failed++
+	}
+}
+
+// rate returns the fraction of failed requests in the window and the number
+// of requests it is based on.
+func (e *errorRateTracker) rate() (float64, int) {
+	oldest := time.Now().Unix() - int64(len(e.buckets))
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	total, failed := 0, 0
+	for _, bucket := range e.buckets {
+		if bucket.second > oldest {
+			total += bucket.total
+			failed += bucket.failed
+		}
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(failed) / float64(total), total
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (t *TodoServer) trackErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		t.errorRate.record(recorder.status >= http.StatusInternalServerError)
+	})
+}
+
+func (t *TodoServer) checkHealthDetail(w http.ResponseWriter, r *http.Request) {
+	rate, requests := t.errorRate.rate()
+	status := "ok"
+	if rate > t.errorRateThreshold {
+		status = "degraded"
+	}
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"status":    status,
+		"errorRate": rate,
+		"requests":  requests,
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthDetailDegradesPastErrorRate(t *testing.T) {
+	s := newTestServer(t, func(c *Config) { c.ErrorRateThreshold = 0.1 })
+	failing := s.trackErrors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	fail := func(n int) {
+		for i := 0; i < n; i++ {
+			failing.ServeHTTP(httptest.NewRecorder(), newRequest("GET", "/", ""))
+		}
+	}
+	status := func() string {
+		t.Helper()
+		var detail struct {
+			Status string
+		}
+		decodeData(t, s.do("GET", "/health/detail", ""), &detail)
+		return detail.Status
+	}
+
+	for i := 0; i < 20; i++ {
+		if w := s.do("GET", "/health", ""); w.Code != http.StatusOK {
+			t.Fatalf("health: status %d", w.Code)
+		}
+	}
+	if got := status(); got != "ok" {
+		t.Errorf("status with no errors = %q, want ok", got)
+	}
+	// 2 failures in 23 requests stays under the 10% threshold
+	fail(2)
+	if got := status(); got != "ok" {
+		t.Errorf("status at 2/23 failures = %q, want ok", got)
+	}
+	// 3 in 25 crosses it
+	fail(1)
+	if got := status(); got != "degraded" {
+		t.Errorf("status at 3/25 failures = %q, want degraded", got)
+	}
+	if w := s.do("GET", "/health", ""); w.Code != http.StatusOK {
+		t.Errorf("health while degraded: status %d, want 200", w.Code)
+	}
+}
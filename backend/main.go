@@ -1,92 +1,576 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
-	"os"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 	log "github.com/sirupsen/logrus"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/plugin/dbresolver"
 )
 
 var (
-	port = flag.String("port", "8000", "http server port")
+	port       = flag.String("port", "8000", "http server port")
+	configFile = flag.String("config", "", "path to a YAML config file")
 )
 
+const (
+	maxDescriptionLength    = 1000
+	maxClientMetadataLength = 256
+
+	// maxImportTodos caps a single import. Rows are inserted importBatchSize
+	// at a time to stay under sqlite's limit on bound variables.
+	maxImportTodos  = 10000
+	importBatchSize = 50
+)
+
+// sortColumns maps the sort keys accepted in ?sort= to their columns. A key
+// may be prefixed with "-" to sort descending.
+var sortColumns = map[string]string{
+	"id":          "id",
+	"createdAt":   "created_at",
+	"updatedAt":   "updated_at",
+	"description": "description",
+}
+
+type todoSort struct {
+	column string
+	desc   bool
+}
+
+func parseSort(value string) (todoSort, error) {
+	if len(value) == 0 {
+		value = "id"
+	}
+	key := strings.TrimPrefix(value, "-")
+	column, ok := sortColumns[key]
+	if !ok {
+		return todoSort{}, fmt.Errorf("unsupported sort: %s", key)
+	}
+	return todoSort{column: column, desc: key != value}, nil
+}
+
+// orderBy renders the sort as an ORDER BY clause, breaking ties by id.
+func (s todoSort) orderBy() string {
+	if s.desc {
+		return s.column + " DESC, id"
+	}
+	return s.column + ", id"
+}
+
+// todoFilter holds the filters accepted by GET /todos.
+type todoFilter struct {
+	status        string
+	completedFrom *time.Time
+	completedTo   *time.Time
+}
+
+func parseTodoFilter(query url.Values, location *time.Location) (todoFilter, error) {
+	var filter todoFilter
+	switch status := query.Get("status"); status {
+	case "", "pending", "completed", "deferred":
+		filter.status = status
+	default:
+		return filter, fmt.Errorf("unsupported status: %s", status)
+	}
+	if value := query.Get("completedBetween"); len(value) > 0 {
+		fromTime, toTime, err := parseWindow(value, time.Now().In(location))
+		if err != nil {
+			return filter, fmt.Errorf("invalid completedBetween: %w", err)
+		}
+		// sqlite compares the stored timestamps as text, so bounds must be
+		// in UTC like the stored times
+		fromTime, toTime = fromTime.UTC(), toTime.UTC()
+		filter.completedFrom, filter.completedTo = &fromTime, &toTime
+	}
+	return filter, nil
+}
+
+// parseWindow parses an inclusive "<from>,<to>" pair of RFC 3339 times, or
+// one of the relative windows "today" and "thisWeek" whose day boundaries
+// are taken in now's location.
+func parseWindow(value string, now time.Time) (time.Time, time.Time, error) {
+	year, month, day := now.Date()
+	today := time.Date(year, month, day, 0, 0, 0, 0, now.Location())
+	switch value {
+	case "today":
+		return today, today.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	case "thisWeek":
+		// weeks start on Monday
+		monday := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+		return monday, monday.AddDate(0, 0, 7).Add(-time.Nanosecond), nil
+	}
+	from, to, ok := strings.Cut(value, ",")
+	if !ok {
+		return time.Time{}, time.Time{}, fmt.Errorf("expected <from>,<to>, today or thisWeek")
+	}
+	fromTime, err := time.Parse(time.RFC3339, strings.TrimSpace(from))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid start: %s", from)
+	}
+	toTime, err := time.Parse(time.RFC3339, strings.TrimSpace(to))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid end: %s", to)
+	}
+	if toTime.Before(fromTime) {
+		return time.Time{}, time.Time{}, fmt.Errorf("end is before start")
+	}
+	return fromTime, toTime, nil
+}
+
+func (f todoFilter) apply(query *gorm.DB) *gorm.DB {
+	switch f.status {
+	case "pending":
+		query = query.Where("Completed = ? AND Deferred = ?", false, false)
+	case "completed":
+		query = query.Where("Completed = ?", true)
+	case "deferred":
+		query = query.Where("Deferred = ?", true)
+	}
+	if f.completedFrom != nil {
+		query = query.Where("completed_at BETWEEN ? AND ?", *f.completedFrom, *f.completedTo)
+	}
+	return query
+}
+
 type TodoServer struct {
-	port string
-	db   *gorm.DB
+	port          string
+	db            *gorm.DB
+	dbFile        string
+	dbReplicaDSN  string
+	corsOrigins   []string
+	maxJSONDepth  int
+	maxJSONTokens int
+	attentionAge  time.Duration
+
+	maxBodyBytes      int64
+	maxDiffBodyBytes  int64
+	maxDiffJSONTokens int
+
+	errorRate          *errorRateTracker
+	errorRateThreshold float64
+
+	queue *workQueue
+
+	maxTodos  int
+	todoCount todoCounter
+
+	defaultSort    string
+	searchCaseFold bool
+
+	pageTokenSecret []byte
+
+	location *time.Location
 }
 
 type Todo struct {
 	gorm.Model
+	PublicID    *string `gorm:"uniqueIndex"`
 	Description string
 	Completed   bool
+	CompletedAt *time.Time
+	Deferred    bool
+	UserAgent   string
+	ClientName  string
+}
+
+// inLocation converts the todo's timestamps to location for output. They
+// are stored in UTC.
+func (todo *Todo) inLocation(location *time.Location) {
+	todo.CreatedAt = todo.CreatedAt.In(location)
+	todo.UpdatedAt = todo.UpdatedAt.In(location)
+	if todo.CompletedAt != nil {
+		completedAt := todo.CompletedAt.In(location)
+		todo.CompletedAt = &completedAt
+	}
+	if todo.DeletedAt.Valid {
+		todo.DeletedAt.Time = todo.DeletedAt.Time.In(location)
+	}
 }
 
 type TodoCreateRequest struct {
+	PublicID    string
 	Description string
+	Completed   bool
 }
 
-func NewTodoServer(port string) *TodoServer {
+// TodoAttention is a pending todo flagged by one of the needs-attention
+// heuristics, along with the reason it was flagged.
+type TodoAttention struct {
+	Todo
+	Reason string
+}
+
+type HistogramBucket struct {
+	Hour  int
+	Count int
+}
+
+// DuplicateGroup lists the ids of todos sharing a normalized description.
+type DuplicateGroup struct {
+	Description string
+	IDs         []uint
+}
+
+type TodoRestoreRequest struct {
+	IDs []uint `json:"ids"`
+}
+
+type TodoMergeRequest struct {
+	SourceID uint `json:"sourceId"`
+	TargetID uint `json:"targetId"`
+}
+
+// validationError carries the message key of a field rule that failed
+// deeper than the request handler, such as inside a query.
+type validationError struct {
+	key string
+}
+
+func (e validationError) Error() string {
+	return e.key
+}
+
+// validate returns the message key of the first failing field rule, or an
+// empty string when the request is valid.
+func (req *TodoCreateRequest) validate() string {
+	description := strings.TrimSpace(req.Description)
+	if len(description) == 0 {
+		return "description.required"
+	}
+	if utf8.RuneCountInString(description) > maxDescriptionLength {
+		return "description.tooLong"
+	}
+	return ""
+}
+
+func NewTodoServer(config Config) *TodoServer {
+	// validated by Config.validate
+	location, _ := time.LoadLocation(config.AppTZ)
 	return &TodoServer{
-		port: port,
+		port:          config.Port,
+		dbFile:        config.DBFile,
+		dbReplicaDSN:  config.DBReplicaDSN,
+		corsOrigins:   config.CORSOrigins,
+		maxJSONDepth:  config.MaxJSONDepth,
+		maxJSONTokens: config.MaxJSONTokens,
+		attentionAge:  time.Duration(config.AttentionAgeDays) * 24 * time.Hour,
+
+		maxBodyBytes:      int64(config.MaxBodyBytes),
+		maxDiffBodyBytes:  int64(config.MaxDiffBodyBytes),
+		maxDiffJSONTokens: config.MaxDiffJSONTokens,
+
+		errorRate:          newErrorRateTracker(time.Duration(config.ErrorRateWindowSeconds) * time.Second),
+		errorRateThreshold: config.ErrorRateThreshold,
+
+		queue: newWorkQueue(config.QueueWorkers, config.QueueCapacity),
+
+		defaultSort:    config.DefaultSort,
+		searchCaseFold: config.SearchCaseFold,
+
+		pageTokenSecret: []byte(config.PageTokenSecret),
+
+		location: location,
+
+		maxTodos: config.MaxTodos,
+	}
+}
+
+// localize converts the todos' timestamps to APP_TZ for output.
+func (t *TodoServer) localize(todos []Todo) {
+	for i := range todos {
+		todos[i].inLocation(t.location)
+	}
+}
+
+// normalizeDescription folds a description for comparison by trimming it
+// and lowercasing it.
+func normalizeDescription(description string) string {
+	return strings.ToLower(strings.TrimSpace(description))
+}
+
+// sanitizeHeader strips control characters from a client supplied header
+// and truncates it to maxClientMetadataLength bytes.
+func sanitizeHeader(value string) string {
+	value = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, value))
+	if len(value) > maxClientMetadataLength {
+		value = strings.ToValidUTF8(value[:maxClientMetadataLength], "")
 	}
+	return value
 }
 
 // Repository
 func (t *TodoServer) setupDb() error {
-	dbName := os.Getenv("DB_FILE")
-	if len(dbName) == 0 {
-		dbName = "test.db"
-	}
-	db, err := gorm.Open(sqlite.Open(dbName), &gorm.Config{})
+	// timestamps are stored in UTC so sqlite's text comparison orders them
+	// correctly whatever the server's zone and its DST changes
+	db, err := gorm.Open(sqlite.Open(t.dbFile), &gorm.Config{
+		NowFunc: func() time.Time { return time.Now().UTC() },
+	})
 	if err != nil {
 		log.Println("failed to connec to database sqlite")
 		return err
 	}
+	// sqlite allows a single writer, so concurrent handlers share one
+	// connection instead of failing with "database is locked"
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	sqlDB.SetMaxOpenConns(1)
 	t.db = db
-	return t.db.Debug().AutoMigrate(&Todo{})
+	if err := t.db.Debug().AutoMigrate(&Todo{}); err != nil {
+		return err
+	}
+	// registered after migrating so schema inspection reads the primary
+	if len(t.dbReplicaDSN) > 0 {
+		return t.db.Use(dbresolver.Register(dbresolver.Config{
+			Replicas: []gorm.Dialector{sqlite.Open(t.dbReplicaDSN)},
+		}))
+	}
+	return nil
 }
 
 func (t *TodoServer) setupHttp() error {
+	if err := http.ListenAndServe(fmt.Sprintf(":%s", t.port), t.routes()); err != nil {
+		log.Panicf("failed to create http server: %s", err)
+	}
+	return nil
+}
+
+func (t *TodoServer) routes() http.Handler {
 	router := mux.NewRouter()
+	router.Use(negotiateVersion)
 	router.HandleFunc("/health", t.checkHealth).Methods("GET")
-	router.HandleFunc("/todo-completed", t.getCompleted).Methods("GET")
-	router.HandleFunc("/todo-pending", t.getPending).Methods("GET")
-	router.HandleFunc("/todo", t.createTodo).Methods("PUT")
-	router.HandleFunc("/todo/{id}", t.updateTodo).Methods("POST")
-	router.HandleFunc("/todo/{id}", t.deleteTodo).Methods("DELETE")
+	router.HandleFunc("/health/detail", t.checkHealthDetail).Methods("GET")
+	router.HandleFunc("/metrics", t.getMetrics).Methods("GET")
+	router.HandleFunc("/admin", t.serveAdmin).Methods("GET")
+	router.HandleFunc("/admin/backup/diff", t.diffBackups).Methods("POST")
 
-	handler := cors.New(cors.Options{
+	// everything below goes through the database work queue
+	api := router.NewRoute().Subrouter()
+	api.Use(t.queue.middleware)
+	api.HandleFunc("/todos", t.listTodos).Methods("GET")
+	api.HandleFunc("/todo-completed", t.getCompleted).Methods("GET")
+	api.HandleFunc("/todo-pending", t.getPending).Methods("GET")
+	api.HandleFunc("/todo", t.createTodo).Methods("PUT")
+	api.HandleFunc("/todo/{id}", t.updateTodo).Methods("POST")
+	api.HandleFunc("/todo/{id}", t.deleteTodo).Methods("DELETE")
+	api.HandleFunc("/todo/{id}/position", t.getPosition).Methods("GET")
+	api.HandleFunc("/todo/{id}/defer", t.deferTodo).Methods("POST")
+	api.HandleFunc("/todo/{id}/reactivate", t.reactivateTodo).Methods("POST")
+	api.HandleFunc("/todo/{id}/bump", t.bumpTodo).Methods("POST")
+	api.HandleFunc("/todos/merge", t.mergeTodos).Methods("POST")
+	api.HandleFunc("/todos/restore", t.restoreTodos).Methods("POST")
+	api.HandleFunc("/admin/recompute", t.recomputeCounters).Methods("POST")
+	api.HandleFunc("/todos/attention", t.getAttention).Methods("GET")
+	api.HandleFunc("/todos/checksum", t.getChecksum).Methods("GET")
+	api.HandleFunc("/todos/completion-histogram", t.getCompletionHistogram).Methods("GET")
+	api.HandleFunc("/todos/duplicates", t.getDuplicates).Methods("GET")
+	api.HandleFunc("/todos/import", t.importTodos).Methods("POST")
+	api.HandleFunc("/todos/export", t.exportTodos).Methods("GET")
+
+	return cors.New(cors.Options{
+		AllowedOrigins: t.corsOrigins,
 		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-	}).Handler(router)
-	if err := http.ListenAndServe(fmt.Sprintf(":%s", t.port), handler); err != nil {
-		log.Panicf("failed to create http server: %s", err)
+	}).Handler(t.trackErrors(router))
+}
+
+func (t *TodoServer) getTodoItemsQuery(completed bool, sort todoSort) []Todo {
+	todos := []Todo{}
+	t.db.Where("Completed = ? AND Deferred = ?", completed, false).Order(sort.orderBy()).Find(&todos)
+	return todos
+}
+
+// listTodosQuery returns the todos matching filter in sort order. A limit of
+// zero returns every match.
+func (t *TodoServer) listTodosQuery(filter todoFilter, sort todoSort, offset, limit int) ([]Todo, error) {
+	todos := []Todo{}
+	query := filter.apply(t.db).Order(sort.orderBy())
+	if limit > 0 {
+		query = query.Offset(offset).Limit(limit)
 	}
-	return nil
+	result := query.Find(&todos)
+	return todos, result.Error
+}
+
+func (t *TodoServer) getStaleTodoItemsQuery(createdBefore time.Time) ([]Todo, error) {
+	todos := []Todo{}
+	result := t.db.Where("Completed = ? AND Deferred = ? AND created_at < ?", false, false, createdBefore).Find(&todos)
+	return todos, result.Error
 }
 
-func (t *TodoServer) getTodoItemsQuery(completed bool) []Todo {
+// checksumQuery hashes the id and last update time of every todo, so any
+// create, update or delete changes the result.
+func (t *TodoServer) checksumQuery() (string, error) {
 	var todos []Todo
-	t.db.Where("Completed = ?", completed).Find(&todos)
-	return todos
+	if err := t.db.Select("id", "updated_at").Order("id").Find(&todos).Error; err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	for _, todo := range todos {
+		fmt.Fprintf(hash, "%d:%d\n", todo.ID, todo.UpdatedAt.UnixNano())
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (t *TodoServer) getCompletionTimesQuery() ([]time.Time, error) {
+	var completedAt []time.Time
+	result := t.db.Model(&Todo{}).Where("Completed = ? AND completed_at IS NOT NULL", true).Pluck("completed_at", &completedAt)
+	return completedAt, result.Error
+}
+
+// positionQuery counts the todos matching the filter that sort before the
+// todo with the given id. Ties on the sort column are broken by id. It
+// returns gorm.ErrRecordNotFound when the todo itself doesn't match.
+func (t *TodoServer) positionQuery(id uint, sort todoSort, filter todoFilter) (int64, error) {
+	var matches int64
+	if err := filter.apply(t.db.Model(&Todo{})).Where("id = ?", id).Count(&matches).Error; err != nil {
+		return 0, err
+	}
+	if matches == 0 {
+		return 0, gorm.ErrRecordNotFound
+	}
+	before := fmt.Sprintf("%[1]s < (SELECT %[1]s FROM todos WHERE id = @id) OR (%[1]s = (SELECT %[1]s FROM todos WHERE id = @id) AND id < @id)", sort.column)
+	if sort.desc {
+		before = strings.Replace(before, "<", ">", 1)
+	}
+	var position int64
+	result := filter.apply(t.db.Model(&Todo{})).Where(before, sql.Named("id", id)).Count(&position)
+	return position, result.Error
+}
+
+// whereSearch narrows query to todos whose description contains term. The
+// term is trimmed and, when case folding is enabled, lowercased the same
+// way descriptions are normalized.
+func (t *TodoServer) whereSearch(query *gorm.DB, term string) *gorm.DB {
+	if !t.searchCaseFold {
+		return query.Where("instr(description, ?) > 0", strings.TrimSpace(term))
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(normalizeDescription(term))
+	return query.Where(`LOWER(description) LIKE ? ESCAPE '\'`, "%"+escaped+"%")
+}
+
+// findPendingMatchQuery returns the first pending todo matching the search
+// term, or nil when there is none. It reads from the primary so a todo that
+// was just created counts as a conflict.
+func (t *TodoServer) findPendingMatchQuery(term string) (*Todo, error) {
+	var todos []Todo
+	result := t.whereSearch(t.db.Clauses(dbresolver.Write).Where("Completed = ? AND Deferred = ?", false, false), term).Order("id").Limit(1).Find(&todos)
+	if result.Error != nil || len(todos) == 0 {
+		return nil, result.Error
+	}
+	return &todos[0], nil
+}
+
+func (t *TodoServer) duplicatesQuery() ([]DuplicateGroup, error) {
+	var todos []Todo
+	if err := t.db.Select("id", "description").Order("id").Find(&todos).Error; err != nil {
+		return nil, err
+	}
+	groups := []DuplicateGroup{}
+	index := map[string]int{}
+	for _, todo := range todos {
+		key := normalizeDescription(todo.Description)
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, DuplicateGroup{Description: key})
+		}
+		groups[i].IDs = append(groups[i].IDs, todo.ID)
+	}
+	duplicates := []DuplicateGroup{}
+	for _, group := range groups {
+		if len(group.IDs) > 1 {
+			duplicates = append(duplicates, group)
+		}
+	}
+	return duplicates, nil
 }
 
 func (t *TodoServer) createTodoQuery(todo *Todo) error {
-	result := t.db.Create(&todo)
-	return result.Error
+	return t.changeTodoCount(func(reserve func(int64) error) (int64, error) {
+		if err := reserve(1); err != nil {
+			return 0, err
+		}
+		result := t.db.Create(todo)
+		return result.RowsAffected, result.Error
+	})
 }
 
+func (t *TodoServer) importTodosQuery(todos []Todo) error {
+	return t.changeTodoCount(func(reserve func(int64) error) (int64, error) {
+		if err := reserve(int64(len(todos))); err != nil {
+			return 0, err
+		}
+		err := t.db.Transaction(func(tx *gorm.DB) error {
+			return tx.CreateInBatches(&todos, importBatchSize).Error
+		})
+		return int64(len(todos)), err
+	})
+}
+
+// upsertTodoQuery inserts the todo, or updates (and restores) the existing
+// row when one with the same public id is already stored. An update clears
+// Deferred, as toggling a todo does. MAX_TODOS only applies when that adds a
+// todo, not when it updates a live one.
+func (t *TodoServer) upsertTodoQuery(todo *Todo) error {
+	return t.changeTodoCount(func(reserve func(int64) error) (int64, error) {
+		var live int64
+		err := t.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&Todo{}).Where("public_id = ?", todo.PublicID).Count(&live).Error; err != nil {
+				return err
+			}
+			if err := reserve(1 - live); err != nil {
+				return err
+			}
+			result := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "public_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"description", "completed", "completed_at", "deferred", "updated_at", "deleted_at"}),
+			}).Create(todo)
+			if result.Error != nil {
+				return result.Error
+			}
+			// read into a fresh value so nothing from the request survives
+			// that wasn't stored
+			stored := Todo{}
+			if err := tx.Where("public_id = ?", todo.PublicID).First(&stored).Error; err != nil {
+				return err
+			}
+			*todo = stored
+			return nil
+		})
+		// only an insert or a restore adds a todo
+		return 1 - live, err
+	})
+}
+
+// getTodoItem reads from the primary, as callers usually go on to modify the
+// todo and a replica may lag behind.
 func (t *TodoServer) getTodoItem(id uint) (*Todo, error) {
 	todo := &Todo{}
-	result := t.db.First(&todo)
+	result := t.db.Clauses(dbresolver.Write).First(todo, id)
 	if result.Error != nil {
 		log.Warnf("todo item not found in database: %d", id)
 		return nil, result.Error
@@ -94,42 +578,336 @@ func (t *TodoServer) getTodoItem(id uint) (*Todo, error) {
 	return todo, nil
 }
 
+// updateTodoQuery writes the todo's scalar columns only. Unlike Save it
+// never upserts or touches associations; Select makes sure zero values such
+// as Completed=false are written too.
 func (t *TodoServer) updateTodoQuery(todo *Todo) error {
-	result := t.db.Save(&todo)
+	result := t.db.Model(todo).Select("Description", "Completed", "CompletedAt", "Deferred").Omit(clause.Associations).Updates(todo)
 	return result.Error
 }
 
 func (t *TodoServer) deleteTodoQuery(todo *Todo) error {
-	result := t.db.Delete(&todo)
-	return result.Error
+	return t.changeTodoCount(func(func(int64) error) (int64, error) {
+		result := t.db.Delete(todo)
+		return -result.RowsAffected, result.Error
+	})
+}
+
+// bumpTodoQuery resets CreatedAt to now so the todo sorts as the newest.
+// UpdatedAt moves as well, which keeps the checksum honest.
+func (t *TodoServer) bumpTodoQuery(todo *Todo) error {
+	return t.db.Model(todo).Update("created_at", time.Now().UTC()).Error
+}
+
+// countDeletedQuery counts the listed todos that are soft-deleted.
+func (t *TodoServer) countDeletedQuery(ids []uint) (int64, error) {
+	var count int64
+	result := t.db.Clauses(dbresolver.Write).Unscoped().Model(&Todo{}).Where("id IN ? AND deleted_at IS NOT NULL", ids).Count(&count)
+	return count, result.Error
+}
+
+// restoreTodosQuery clears DeletedAt on the listed soft-deleted todos and
+// returns how many were restored; ids of live or unknown todos are ignored.
+// Nothing is restored unless all of them fit within MAX_TODOS.
+func (t *TodoServer) restoreTodosQuery(ids []uint) (int64, error) {
+	var restored int64
+	err := t.changeTodoCount(func(reserve func(int64) error) (int64, error) {
+		deleted, err := t.countDeletedQuery(ids)
+		if err != nil {
+			return 0, err
+		}
+		if err := reserve(deleted); err != nil {
+			return 0, err
+		}
+		result := t.db.Unscoped().Model(&Todo{}).Where("id IN ? AND deleted_at IS NOT NULL", ids).Update("deleted_at", nil)
+		restored = result.RowsAffected
+		return restored, result.Error
+	})
+	return restored, err
+}
+
+// mergeTodoQuery folds the source description into the target and soft
+// deletes the source in a single transaction. A merged description that
+// breaks the create rules fails with a validationError.
+func (t *TodoServer) mergeTodoQuery(sourceID, targetID uint) (*Todo, error) {
+	target := &Todo{}
+	err := t.changeTodoCount(func(func(int64) error) (int64, error) {
+		err := t.db.Transaction(func(tx *gorm.DB) error {
+			source := &Todo{}
+			if err := tx.First(source, sourceID).Error; err != nil {
+				return err
+			}
+			if err := tx.First(target, targetID).Error; err != nil {
+				return err
+			}
+			merged := TodoCreateRequest{Description: strings.TrimSpace(target.Description + "\n" + source.Description)}
+			if key := merged.validate(); key != "" {
+				return validationError{key: key}
+			}
+			target.Description = merged.Description
+			if err := tx.Model(target).Update("description", target.Description).Error; err != nil {
+				return err
+			}
+			return tx.Delete(source).Error
+		})
+		// the source is the one todo removed
+		return -1, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return target, nil
 }
 
 // Services
+
+// sortParam parses ?sort=, falling back to the configured DEFAULT_SORT.
+func (t *TodoServer) sortParam(query url.Values) (todoSort, error) {
+	value := query.Get("sort")
+	if len(value) == 0 {
+		value = t.defaultSort
+	}
+	return parseSort(value)
+}
+
 func (t *TodoServer) createTodo(w http.ResponseWriter, r *http.Request) {
 	var todoRequest TodoCreateRequest
-	if err := json.NewDecoder(r.Body).Decode(&todoRequest); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := t.decodeJSON(w, r, &todoRequest); err != nil {
+		writeError(w, r, bodyErrorStatus(err), err.Error())
 		return
 	}
-	todo := &Todo{Description: todoRequest.Description, Completed: false}
-	if err := t.createTodoQuery(todo); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if key := todoRequest.validate(); key != "" {
+		writeError(w, r, http.StatusBadRequest, message(r, key))
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(todo)
+	if term := r.URL.Query().Get("unlessExists"); len(strings.TrimSpace(term)) > 0 {
+		existing, err := t.findPendingMatchQuery(term)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if existing != nil {
+			existing.inLocation(t.location)
+			writeJSON(w, r, http.StatusConflict, existing)
+			return
+		}
+	}
+	todo := &Todo{
+		Description: todoRequest.Description,
+		Completed:   todoRequest.Completed,
+		UserAgent:   sanitizeHeader(r.UserAgent()),
+		ClientName:  sanitizeHeader(r.Header.Get("X-Client-Name")),
+	}
+	if todo.Completed {
+		now := time.Now().UTC()
+		todo.CompletedAt = &now
+	}
+	save := t.createTodoQuery
+	if len(todoRequest.PublicID) > 0 {
+		todo.PublicID = &todoRequest.PublicID
+		save = t.upsertTodoQuery
+	}
+	err := save(todo)
+	if errors.Is(err, errTodoLimit) {
+		writeError(w, r, http.StatusForbidden, t.todoLimitMessage())
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	todo.inLocation(t.location)
+	writeJSON(w, r, http.StatusOK, todo)
+}
+
+// importTodos creates one pending todo per non-empty line of a plain text
+// body. Either every line is imported or none are.
+func (t *TodoServer) importTodos(w http.ResponseWriter, r *http.Request) {
+	if format := r.URL.Query().Get("format"); format != "text" {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("unsupported format: %s", format))
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, t.maxBodyBytes))
+	if err != nil {
+		writeError(w, r, bodyErrorStatus(err), err.Error())
+		return
+	}
+	todos := []Todo{}
+	for i, line := range strings.Split(string(body), "\n") {
+		todoRequest := TodoCreateRequest{Description: strings.TrimSpace(line)}
+		if len(todoRequest.Description) == 0 {
+			continue
+		}
+		if key := todoRequest.validate(); key != "" {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("line %d: %s", i+1, message(r, key)))
+			return
+		}
+		if len(todos) == maxImportTodos {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("line %d: imports are limited to %d todos", i+1, maxImportTodos))
+			return
+		}
+		todos = append(todos, Todo{
+			Description: todoRequest.Description,
+			UserAgent:   sanitizeHeader(r.UserAgent()),
+			ClientName:  sanitizeHeader(r.Header.Get("X-Client-Name")),
+		})
+	}
+	if len(todos) == 0 {
+		writeError(w, r, http.StatusBadRequest, errEmptyBody.Error())
+		return
+	}
+	err = t.importTodosQuery(todos)
+	if errors.Is(err, errTodoLimit) {
+		writeError(w, r, http.StatusForbidden, t.todoLimitMessage())
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	t.localize(todos)
+	writeJSON(w, r, http.StatusOK, todos)
+}
+
+// listTodos lists todos matching the query filters, or just their ids with
+// ?idsOnly=true. With ?limit= the list
+// is paged and the X-Next-Token header carries a signed token that restores
+// the filters, sort and offset of the next page via ?pageToken=.
+func (t *TodoServer) listTodos(w http.ResponseWriter, r *http.Request) {
+	page := pageState{Query: r.URL.Query()}
+	if token := page.Query.Get("pageToken"); len(token) > 0 {
+		var err error
+		if page, err = t.decodePageToken(token); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	} else if value := page.Query.Get("limit"); len(value) > 0 {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+			return
+		}
+		page.Limit = limit
+		page.Query.Del("limit")
+	}
+	filter, err := parseTodoFilter(page.Query, t.location)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	sort, err := t.sortParam(page.Query)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit := page.Limit
+	if limit > 0 {
+		// fetch one extra row to tell whether another page follows
+		limit++
+	}
+	todos, err := t.listTodosQuery(filter, sort, page.Offset, limit)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if page.Limit > 0 && len(todos) > page.Limit {
+		todos = todos[:page.Limit]
+		next := pageState{Query: page.Query, Offset: page.Offset + page.Limit, Limit: page.Limit}
+		token, err := t.encodePageToken(next)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("X-Next-Token", token)
+	}
+	if idsOnly, _ := strconv.ParseBool(page.Query.Get("idsOnly")); idsOnly {
+		ids := make([]uint, len(todos))
+		for i, todo := range todos {
+			ids[i] = todo.ID
+		}
+		writeJSON(w, r, http.StatusOK, ids)
+		return
+	}
+	t.localize(todos)
+	writeJSON(w, r, http.StatusOK, todos)
 }
 
 func (t *TodoServer) getCompleted(w http.ResponseWriter, r *http.Request) {
-	completedItems := t.getTodoItemsQuery(true)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(completedItems)
+	sort, err := t.sortParam(r.URL.Query())
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	completedItems := t.getTodoItemsQuery(true, sort)
+	t.localize(completedItems)
+	writeJSON(w, r, http.StatusOK, completedItems)
 }
 
 func (t *TodoServer) getPending(w http.ResponseWriter, r *http.Request) {
-	pendingItems := t.getTodoItemsQuery(false)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(pendingItems)
+	sort, err := t.sortParam(r.URL.Query())
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	pendingItems := t.getTodoItemsQuery(false, sort)
+	t.localize(pendingItems)
+	writeJSON(w, r, http.StatusOK, pendingItems)
+}
+
+// getAttention lists pending todos that need attention. Todos carry no
+// priority or due date yet, so age is currently the only heuristic.
+func (t *TodoServer) getAttention(w http.ResponseWriter, r *http.Request) {
+	staleItems, err := t.getStaleTodoItemsQuery(time.Now().UTC().Add(-t.attentionAge))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	items := make([]TodoAttention, 0, len(staleItems))
+	for _, todo := range staleItems {
+		todo.inLocation(t.location)
+		items = append(items, TodoAttention{Todo: todo, Reason: "stale"})
+	}
+	writeJSON(w, r, http.StatusOK, items)
+}
+
+func (t *TodoServer) getChecksum(w http.ResponseWriter, r *http.Request) {
+	checksum, err := t.checksumQuery()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]string{"checksum": checksum})
+}
+
+// getCompletionHistogram counts completions per hour of day in the APP_TZ
+// timezone.
+func (t *TodoServer) getCompletionHistogram(w http.ResponseWriter, r *http.Request) {
+	if bucket := r.URL.Query().Get("bucket"); bucket != "" && bucket != "hour" {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("unsupported bucket: %s", bucket))
+		return
+	}
+	completedAt, err := t.getCompletionTimesQuery()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	histogram := make([]HistogramBucket, 24)
+	for hour := range histogram {
+		histogram[hour].Hour = hour
+	}
+	for _, at := range completedAt {
+		histogram[at.In(t.location).Hour()].Count++
+	}
+	writeJSON(w, r, http.StatusOK, histogram)
+}
+
+func (t *TodoServer) getDuplicates(w http.ResponseWriter, r *http.Request) {
+	duplicates, err := t.duplicatesQuery()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, duplicates)
 }
 
 func (t *TodoServer) updateTodo(w http.ResponseWriter, r *http.Request) {
@@ -137,34 +915,177 @@ func (t *TodoServer) updateTodo(w http.ResponseWriter, r *http.Request) {
 	id, _ := strconv.Atoi(vars["id"])
 	todo, err := t.getTodoItem(uint(id))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 	todo.Completed = !todo.Completed
+	todo.CompletedAt = nil
+	todo.Deferred = false
+	if todo.Completed {
+		now := time.Now().UTC()
+		todo.CompletedAt = &now
+	}
 	if err := t.updateTodoQuery(todo); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(todo)
+	todo.inLocation(t.location)
+	writeJSON(w, r, http.StatusOK, todo)
+}
+
+// deferTodo moves a pending todo to someday/maybe, hiding it from the
+// pending list until it is reactivated.
+func (t *TodoServer) deferTodo(w http.ResponseWriter, r *http.Request) {
+	t.setDeferred(w, r, true)
+}
+
+func (t *TodoServer) reactivateTodo(w http.ResponseWriter, r *http.Request) {
+	t.setDeferred(w, r, false)
+}
+
+func (t *TodoServer) setDeferred(w http.ResponseWriter, r *http.Request, deferred bool) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+	todo, err := t.getTodoItem(uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if deferred && todo.Completed {
+		writeError(w, r, http.StatusConflict, "cannot defer a completed todo")
+		return
+	}
+	todo.Deferred = deferred
+	if err := t.updateTodoQuery(todo); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	todo.inLocation(t.location)
+	writeJSON(w, r, http.StatusOK, todo)
+}
+
+func (t *TodoServer) bumpTodo(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+	todo, err := t.getTodoItem(uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := t.bumpTodoQuery(todo); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	todo.inLocation(t.location)
+	writeJSON(w, r, http.StatusOK, todo)
+}
+
+// getPosition returns the zero-based index of a todo within GET /todos for
+// the same ?sort= and filters, such as ?status=.
+func (t *TodoServer) getPosition(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+	sort, err := t.sortParam(r.URL.Query())
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter, err := parseTodoFilter(r.URL.Query(), t.location)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	position, err := t.positionQuery(uint(id), sort, filter)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeError(w, r, http.StatusNotFound, "todo not found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]int64{"position": position})
 }
 
 func (t *TodoServer) deleteTodo(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, _ := strconv.Atoi(vars["id"])
 	todo, err := t.getTodoItem(uint(id))
+	// soft-deleted todos are scoped out, so deleting twice lands here too
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeError(w, r, http.StatusNotFound, fmt.Sprintf("todo %d not found", id))
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 	if err := t.deleteTodoQuery(todo); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte("{'deleted'}: true"))
 }
 
+func (t *TodoServer) mergeTodos(w http.ResponseWriter, r *http.Request) {
+	var mergeRequest TodoMergeRequest
+	if err := t.decodeJSON(w, r, &mergeRequest); err != nil {
+		writeError(w, r, bodyErrorStatus(err), err.Error())
+		return
+	}
+	if mergeRequest.SourceID == mergeRequest.TargetID {
+		writeError(w, r, http.StatusBadRequest, "cannot merge a todo into itself")
+		return
+	}
+	todo, err := t.mergeTodoQuery(mergeRequest.SourceID, mergeRequest.TargetID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	var invalid validationError
+	if errors.As(err, &invalid) {
+		writeError(w, r, http.StatusBadRequest, message(r, invalid.key))
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	todo.inLocation(t.location)
+	writeJSON(w, r, http.StatusOK, todo)
+}
+
+func (t *TodoServer) restoreTodos(w http.ResponseWriter, r *http.Request) {
+	var restoreRequest TodoRestoreRequest
+	if err := t.decodeJSON(w, r, &restoreRequest); err != nil {
+		writeError(w, r, bodyErrorStatus(err), err.Error())
+		return
+	}
+	if len(restoreRequest.IDs) == 0 {
+		writeError(w, r, http.StatusBadRequest, "ids are required")
+		return
+	}
+	restored, err := t.restoreTodosQuery(restoreRequest.IDs)
+	if errors.Is(err, errTodoLimit) {
+		writeError(w, r, http.StatusForbidden, t.todoLimitMessage())
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]int64{"restored": restored})
+}
+
 func (t *TodoServer) checkHealth(w http.ResponseWriter, r *http.Request) {
 	log.Info("Health is OK")
 	w.Header().Set("Content-Type", "application/json")
@@ -180,7 +1101,17 @@ func (t *TodoServer) Start() error {
 
 func main() {
 	flag.Parse()
-	t := NewTodoServer(*port)
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.applyFlags(flag.CommandLine)
+	if err := config.validate(); err != nil {
+		log.Fatal(err)
+	}
+	level, _ := log.ParseLevel(config.LogLevel)
+	log.SetLevel(level)
+	t := NewTodoServer(config)
 	if err := t.Start(); err != nil {
 		log.Fatal(err)
 	}
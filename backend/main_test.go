@@ -0,0 +1,1141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testServer wraps a TodoServer backed by a sqlite database in a temporary
+// directory, with its routes ready to serve requests in-process.
+type testServer struct {
+	*TodoServer
+	t       *testing.T
+	handler http.Handler
+}
+
+// newTestServer builds a server from the default config, after letting each
+// configure func adjust it.
+func newTestServer(t *testing.T, configure ...func(*Config)) *testServer {
+	t.Helper()
+	config := defaultConfig()
+	config.DBFile = filepath.Join(t.TempDir(), "test.db")
+	config.PageTokenSecret = "test secret"
+	for _, fn := range configure {
+		fn(&config)
+	}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	server := NewTodoServer(config)
+	if err := server.setupDb(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := server.db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return &testServer{TodoServer: server, t: t, handler: server.routes()}
+}
+
+func newRequest(method, target, body string) *http.Request {
+	return httptest.NewRequest(method, target, strings.NewReader(body))
+}
+
+func (s *testServer) do(method, target, body string) *httptest.ResponseRecorder {
+	return s.serve(newRequest(method, target, body))
+}
+
+func (s *testServer) serve(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, r)
+	return w
+}
+
+// create adds a pending todo through PUT /todo and returns it.
+func (s *testServer) create(description string) Todo {
+	s.t.Helper()
+	w := s.do("PUT", "/todo", jsonBody(s.t, TodoCreateRequest{Description: description}))
+	if w.Code != http.StatusOK {
+		s.t.Fatalf("create %q: status %d: %s", description, w.Code, w.Body)
+	}
+	var todo Todo
+	decodeData(s.t, w, &todo)
+	return todo
+}
+
+func jsonBody(t *testing.T, v interface{}) string {
+	t.Helper()
+	body, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+// decodeData decodes the data of an enveloped (v2) response into v.
+func decodeData(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := unwrapData(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decode %s: %v", w.Body, err)
+	}
+}
+
+func unwrapData(body []byte, v interface{}) error {
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return err
+	}
+	return json.Unmarshal(envelope.Data, v)
+}
+
+// TestConcurrentRequests runs creates, reads, toggles and deletes from many
+// goroutines at once, together with the health and metrics endpoints, so
+// go test -race covers the todo counter, work queue and error rate tracker.
+func TestConcurrentRequests(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.MaxTodos = 1000
+		c.QueueCapacity = 200
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				w := s.do("PUT", "/todo", fmt.Sprintf(`{"description":"todo %d-%d"}`, i, j))
+				if w.Code != http.StatusOK {
+					t.Errorf("create: status %d: %s", w.Code, w.Body)
+					return
+				}
+				var todo Todo
+				if err := unwrapData(w.Body.Bytes(), &todo); err != nil {
+					t.Errorf("create: %v", err)
+					return
+				}
+				for _, request := range []struct{ method, target string }{
+					{"GET", "/todos"},
+					{"GET", "/todo-pending"},
+					{"POST", fmt.Sprintf("/todo/%d", todo.ID)},
+					{"GET", "/health/detail"},
+					{"GET", "/metrics"},
+					{"DELETE", fmt.Sprintf("/todo/%d", todo.ID)},
+				} {
+					if w := s.do(request.method, request.target, ""); w.Code != http.StatusOK {
+						t.Errorf("%s %s: status %d: %s", request.method, request.target, w.Code, w.Body)
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	count, err := s.countTodos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("cached count = %d after deleting every todo, want 0", count)
+	}
+	if rate, requests := s.errorRate.rate(); rate != 0 || requests != 20*5*7 {
+		t.Errorf("error rate = %v over %d requests, want 0 over %d", rate, requests, 20*5*7)
+	}
+}
+
+func TestMergeTodos(t *testing.T) {
+	s := newTestServer(t)
+	target := s.create("buy milk")
+	source := s.create("and eggs")
+
+	w := s.do("POST", "/todos/merge", fmt.Sprintf(`{"sourceId":%d,"targetId":%d}`, source.ID, target.ID))
+	if w.Code != http.StatusOK {
+		t.Fatalf("merge: status %d: %s", w.Code, w.Body)
+	}
+	var merged Todo
+	decodeData(t, w, &merged)
+	if merged.ID != target.ID || merged.Description != "buy milk\nand eggs" {
+		t.Errorf("merged = %d %q, want %d %q", merged.ID, merged.Description, target.ID, "buy milk\nand eggs")
+	}
+
+	var trashed Todo
+	if err := s.db.Unscoped().First(&trashed, source.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !trashed.DeletedAt.Valid {
+		t.Error("source was not soft-deleted")
+	}
+	var todos []Todo
+	decodeData(t, s.do("GET", "/todos", ""), &todos)
+	if len(todos) != 1 || todos[0].ID != target.ID {
+		t.Errorf("todos after merge = %+v, want only the target", todos)
+	}
+}
+
+func TestMergeTodosRejectsInvalidPairs(t *testing.T) {
+	s := newTestServer(t)
+	todo := s.create("buy milk")
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"into itself", fmt.Sprintf(`{"sourceId":%d,"targetId":%d}`, todo.ID, todo.ID), http.StatusBadRequest},
+		{"missing source", fmt.Sprintf(`{"sourceId":%d,"targetId":%d}`, todo.ID+1, todo.ID), http.StatusNotFound},
+		{"missing target", fmt.Sprintf(`{"sourceId":%d,"targetId":%d}`, todo.ID, todo.ID+1), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := s.do("POST", "/todos/merge", tt.body); w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+	if err := s.db.First(&Todo{}, todo.ID).Error; err != nil {
+		t.Errorf("todo was removed by a rejected merge: %v", err)
+	}
+}
+
+func TestMergeTodosRejectsTooLongDescription(t *testing.T) {
+	s := newTestServer(t)
+	source := s.create(strings.Repeat("a", 900))
+	target := s.create(strings.Repeat("b", 900))
+
+	w := s.do("POST", "/todos/merge", fmt.Sprintf(`{"sourceId":%d,"targetId":%d}`, source.ID, target.ID))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "at most 1000 characters") {
+		t.Fatalf("merge: status %d: %s, want 400 description.tooLong", w.Code, w.Body)
+	}
+	var stored Todo
+	if err := s.db.First(&stored, target.ID).Error; err != nil || len(stored.Description) != 900 {
+		t.Errorf("target after rejected merge = %d chars (%v), want it unchanged", len(stored.Description), err)
+	}
+	if err := s.db.First(&Todo{}, source.ID).Error; err != nil {
+		t.Errorf("source was removed by a rejected merge: %v", err)
+	}
+}
+
+// TestUpdateTodoTogglesRequestedID guards against getTodoItem ignoring the
+// id and returning the first row.
+func TestUpdateTodoTogglesRequestedID(t *testing.T) {
+	s := newTestServer(t)
+	first := s.create("first")
+	second := s.create("second")
+
+	w := s.do("POST", fmt.Sprintf("/todo/%d", second.ID), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: status %d: %s", w.Code, w.Body)
+	}
+	var stored []Todo
+	s.db.Order("id").Find(&stored)
+	if stored[0].ID != first.ID || stored[0].Completed || !stored[1].Completed {
+		t.Errorf("after toggling %d: %+v", second.ID, stored)
+	}
+}
+
+func TestUpsertByPublicID(t *testing.T) {
+	s := newTestServer(t)
+	upsert := func(body string) Todo {
+		t.Helper()
+		w := s.do("PUT", "/todo", body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("upsert %s: status %d: %s", body, w.Code, w.Body)
+		}
+		var todo Todo
+		decodeData(t, w, &todo)
+		return todo
+	}
+
+	inserted := upsert(`{"publicId":"client-1","description":"buy milk"}`)
+	if inserted.ID == 0 || inserted.PublicID == nil || *inserted.PublicID != "client-1" {
+		t.Fatalf("insert = %+v, want a new todo with publicId client-1", inserted)
+	}
+
+	updated := upsert(`{"publicId":"client-1","description":"buy oat milk","completed":true}`)
+	if updated.ID != inserted.ID || updated.Description != "buy oat milk" || !updated.Completed || updated.CompletedAt == nil {
+		t.Errorf("update = %+v, want todo %d completed as %q", updated, inserted.ID, "buy oat milk")
+	}
+	var stored Todo
+	if err := s.db.First(&stored, inserted.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.Description != "buy oat milk" || !stored.Completed || stored.CompletedAt == nil {
+		t.Errorf("stored = %+v, want the update persisted", stored)
+	}
+
+	reopened := upsert(`{"publicId":"client-1","description":"buy oat milk"}`)
+	if reopened.Completed || reopened.CompletedAt != nil {
+		t.Errorf("reopen = %+v, want pending with no CompletedAt", reopened)
+	}
+
+	var count int64
+	s.db.Model(&Todo{}).Count(&count)
+	if count != 1 {
+		t.Errorf("%d todos stored, want 1", count)
+	}
+}
+
+func TestUpsertRestoresDeletedTodo(t *testing.T) {
+	s := newTestServer(t)
+	w := s.do("PUT", "/todo", `{"publicId":"client-1","description":"buy milk"}`)
+	var todo Todo
+	decodeData(t, w, &todo)
+	if w := s.do("DELETE", fmt.Sprintf("/todo/%d", todo.ID), ""); w.Code != http.StatusOK {
+		t.Fatalf("delete: status %d", w.Code)
+	}
+
+	w = s.do("PUT", "/todo", `{"publicId":"client-1","description":"buy milk again"}`)
+	var restored Todo
+	decodeData(t, w, &restored)
+	if restored.ID != todo.ID || restored.DeletedAt.Valid || restored.Description != "buy milk again" {
+		t.Errorf("upsert of a deleted publicId = %+v, want todo %d restored", restored, todo.ID)
+	}
+}
+
+// age moves a todo's CreatedAt into the past.
+func (s *testServer) age(id uint, by time.Duration) {
+	s.t.Helper()
+	if err := s.db.Model(&Todo{}).Where("id = ?", id).Update("created_at", time.Now().UTC().Add(-by)).Error; err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+func TestAttentionListsStalePendingTodos(t *testing.T) {
+	s := newTestServer(t, func(c *Config) { c.AttentionAgeDays = 3 })
+	fresh := s.create("fresh")
+	stale := s.create("stale")
+	staleCompleted := s.create("stale but completed")
+	staleDeferred := s.create("stale but deferred")
+	for _, id := range []uint{stale.ID, staleCompleted.ID, staleDeferred.ID} {
+		s.age(id, 4*24*time.Hour)
+	}
+	s.age(fresh.ID, 2*24*time.Hour)
+	s.do("POST", fmt.Sprintf("/todo/%d", staleCompleted.ID), "")
+	s.do("POST", fmt.Sprintf("/todo/%d/defer", staleDeferred.ID), "")
+
+	w := s.do("GET", "/todos/attention", "")
+	var items []TodoAttention
+	decodeData(t, w, &items)
+	if len(items) != 1 || items[0].ID != stale.ID || items[0].Reason != "stale" {
+		t.Errorf("attention = %+v, want only todo %d flagged stale", items, stale.ID)
+	}
+}
+
+func TestClientMetadataRoundTrips(t *testing.T) {
+	s := newTestServer(t)
+	r := newRequest("PUT", "/todo", `{"description":"buy milk"}`)
+	r.Header.Set("User-Agent", "todo-cli/1.2")
+	r.Header.Set("X-Client-Name", "laptop\tcli")
+	var created Todo
+	decodeData(t, s.serve(r), &created)
+
+	var todos []Todo
+	decodeData(t, s.do("GET", "/todos", ""), &todos)
+	for _, todo := range []Todo{created, todos[0]} {
+		if todo.UserAgent != "todo-cli/1.2" || todo.ClientName != "laptopcli" {
+			t.Errorf("metadata = %q %q, want %q %q", todo.UserAgent, todo.ClientName, "todo-cli/1.2", "laptopcli")
+		}
+	}
+}
+
+func TestSanitizeHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"plain", "todo-cli/1.2", "todo-cli/1.2"},
+		{"control characters", " a\x00b\x7fc\n", "abc"},
+		{"truncated", strings.Repeat("a", 300), strings.Repeat("a", maxClientMetadataLength)},
+		{"truncated inside a rune", "a" + strings.Repeat("é", 200), "a" + strings.Repeat("é", 127)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeHeader(tt.value); got != tt.want {
+				t.Errorf("sanitizeHeader(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChecksumChangesOnlyOnMutation(t *testing.T) {
+	s := newTestServer(t)
+	checksum := func() string {
+		t.Helper()
+		var body map[string]string
+		decodeData(t, s.do("GET", "/todos/checksum", ""), &body)
+		return body["checksum"]
+	}
+
+	todo := s.create("buy milk")
+	before := checksum()
+	if again := checksum(); again != before {
+		t.Fatalf("checksum changed without a mutation: %s then %s", before, again)
+	}
+	mutations := []struct {
+		name   string
+		method string
+		target string
+	}{
+		{"toggle", "POST", fmt.Sprintf("/todo/%d", todo.ID)},
+		{"create", "PUT", "/todo"},
+		{"delete", "DELETE", fmt.Sprintf("/todo/%d", todo.ID)},
+	}
+	for _, m := range mutations {
+		if w := s.do(m.method, m.target, `{"description":"another"}`); w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", m.name, w.Code, w.Body)
+		}
+		after := checksum()
+		if after == before {
+			t.Errorf("checksum unchanged after %s", m.name)
+		}
+		before = after
+	}
+}
+
+// complete marks a todo completed at the given time.
+func (s *testServer) complete(id uint, at time.Time) {
+	s.t.Helper()
+	if err := s.db.Model(&Todo{}).Where("id = ?", id).Updates(map[string]interface{}{"completed": true, "completed_at": at}).Error; err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+func TestCompletionHistogramUsesAppTimezone(t *testing.T) {
+	s := newTestServer(t, func(c *Config) { c.AppTZ = "Asia/Kolkata" })
+	// 10:00 and 10:45 UTC are 15:30 and 16:15 in Kolkata
+	s.complete(s.create("a").ID, time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC))
+	s.complete(s.create("b").ID, time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC))
+	s.complete(s.create("c").ID, time.Date(2026, 3, 2, 10, 45, 0, 0, time.UTC))
+	s.create("pending")
+
+	var histogram []HistogramBucket
+	decodeData(t, s.do("GET", "/todos/completion-histogram?bucket=hour", ""), &histogram)
+	if len(histogram) != 24 {
+		t.Fatalf("%d buckets, want 24", len(histogram))
+	}
+	for hour, bucket := range histogram {
+		want := map[int]int{15: 2, 16: 1}[hour]
+		if bucket.Hour != hour || bucket.Count != want {
+			t.Errorf("bucket %d = %+v, want count %d", hour, bucket, want)
+		}
+	}
+
+	if w := s.do("GET", "/todos/completion-histogram?bucket=day", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("bucket=day: status %d, want 400", w.Code)
+	}
+}
+
+func TestPositionMatchesSortedList(t *testing.T) {
+	s := newTestServer(t)
+	for _, description := range []string{"pear", "apple", "fig", "apple", "banana"} {
+		s.create(description)
+	}
+	for _, sort := range []string{"id", "-id", "description", "-description", "-createdAt"} {
+		t.Run(sort, func(t *testing.T) {
+			var todos []Todo
+			decodeData(t, s.do("GET", "/todos?sort="+sort, ""), &todos)
+			for want, todo := range todos {
+				var body map[string]int
+				decodeData(t, s.do("GET", fmt.Sprintf("/todo/%d/position?sort=%s", todo.ID, sort), ""), &body)
+				if body["position"] != want {
+					t.Errorf("position of %d (%s) = %d, want %d", todo.ID, todo.Description, body["position"], want)
+				}
+			}
+		})
+	}
+	if w := s.do("GET", "/todo/99/position", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown id: status %d, want 404", w.Code)
+	}
+}
+
+func TestCreateUnlessExists(t *testing.T) {
+	s := newTestServer(t)
+	existing := s.create("buy milk")
+	finished := s.create("call mom")
+	s.do("POST", fmt.Sprintf("/todo/%d", finished.ID), "")
+
+	w := s.do("PUT", "/todo?unlessExists=milk", `{"description":"buy more milk"}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("matching pending todo: status %d, want 409: %s", w.Code, w.Body)
+	}
+	var conflict Todo
+	decodeData(t, w, &conflict)
+	if conflict.ID != existing.ID {
+		t.Errorf("conflict = todo %d, want %d", conflict.ID, existing.ID)
+	}
+
+	for _, term := range []string{"bread", "call"} {
+		w := s.do("PUT", "/todo?unlessExists="+term, `{"description":"buy bread"}`)
+		if w.Code != http.StatusOK {
+			t.Errorf("unlessExists=%s: status %d, want 200: %s", term, w.Code, w.Body)
+		}
+	}
+	var count int64
+	s.db.Model(&Todo{}).Count(&count)
+	if count != 4 {
+		t.Errorf("%d todos stored, want 4", count)
+	}
+}
+
+func TestDefaultSort(t *testing.T) {
+	tests := []struct {
+		defaultSort string
+		want        []string
+	}{
+		{"", []string{"pear", "apple", "fig"}},
+		{"description", []string{"apple", "fig", "pear"}},
+		{"-id", []string{"fig", "apple", "pear"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.defaultSort, func(t *testing.T) {
+			s := newTestServer(t, func(c *Config) { c.DefaultSort = tt.defaultSort })
+			for _, description := range []string{"pear", "apple", "fig"} {
+				s.create(description)
+			}
+			for _, target := range []string{"/todo-pending", "/todos"} {
+				var todos []Todo
+				decodeData(t, s.do("GET", target, ""), &todos)
+				var got []string
+				for _, todo := range todos {
+					got = append(got, todo.Description)
+				}
+				if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+					t.Errorf("%s = %v, want %v", target, got, tt.want)
+				}
+			}
+			// an explicit ?sort= still wins
+			var todos []Todo
+			decodeData(t, s.do("GET", "/todo-pending?sort=-description", ""), &todos)
+			if todos[0].Description != "pear" {
+				t.Errorf("?sort=-description starts with %q, want pear", todos[0].Description)
+			}
+		})
+	}
+}
+
+func TestDefaultSortIsValidated(t *testing.T) {
+	config := defaultConfig()
+	config.DefaultSort = "priority"
+	if err := config.validate(); err == nil {
+		t.Error("DEFAULT_SORT=priority was accepted")
+	}
+}
+
+func TestDuplicatesGroupsNormalizedDescriptions(t *testing.T) {
+	s := newTestServer(t)
+	milk := s.create("Buy milk")
+	s.create("call mom")
+	milkAgain := s.create("  buy MILK ")
+	bread := s.create("bread")
+	breadAgain := s.create("Bread")
+
+	var groups []DuplicateGroup
+	decodeData(t, s.do("GET", "/todos/duplicates", ""), &groups)
+	want := []DuplicateGroup{
+		{Description: "buy milk", IDs: []uint{milk.ID, milkAgain.ID}},
+		{Description: "bread", IDs: []uint{bread.ID, breadAgain.ID}},
+	}
+	if fmt.Sprint(groups) != fmt.Sprint(want) {
+		t.Errorf("duplicates = %+v, want %+v", groups, want)
+	}
+}
+
+// newReplica creates a migrated sqlite database holding the given todos, to
+// stand in for a read replica that is out of sync with the primary.
+func newReplica(t *testing.T, descriptions ...string) string {
+	t.Helper()
+	dsn := filepath.Join(t.TempDir(), "replica.db")
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ := db.DB()
+	defer sqlDB.Close()
+	if err := db.AutoMigrate(&Todo{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, description := range descriptions {
+		if err := db.Create(&Todo{Description: description}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dsn
+}
+
+func TestReadsTargetReplica(t *testing.T) {
+	replica := newReplica(t, "only on the replica")
+	s := newTestServer(t, func(c *Config) { c.DBReplicaDSN = replica })
+	written := s.create("only on the primary")
+
+	var todos []Todo
+	decodeData(t, s.do("GET", "/todos", ""), &todos)
+	if len(todos) != 1 || todos[0].Description != "only on the replica" {
+		t.Errorf("GET /todos = %+v, want the replica's todo", todos)
+	}
+	// reads that precede a write stay on the primary. Both databases hold
+	// id 1, so the description tells which one was read.
+	w := s.do("POST", fmt.Sprintf("/todo/%d", written.ID), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("toggle: status %d: %s", w.Code, w.Body)
+	}
+	var toggled Todo
+	decodeData(t, w, &toggled)
+	if toggled.Description != "only on the primary" || !toggled.Completed {
+		t.Errorf("toggled = %q completed=%v, want the primary's todo completed", toggled.Description, toggled.Completed)
+	}
+}
+
+func TestWriteChecksReadPrimary(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.DBReplicaDSN = newReplica(t)
+		c.MaxTodos = 1
+	})
+	s.create("buy milk")
+
+	if w := s.do("PUT", "/todo?unlessExists=milk", `{"description":"buy milk"}`); w.Code != http.StatusConflict {
+		t.Errorf("unlessExists with an empty replica: status %d, want 409", w.Code)
+	}
+	if w := s.do("PUT", "/todo", `{"description":"buy bread"}`); w.Code != http.StatusForbidden {
+		t.Errorf("create past MAX_TODOS with an empty replica: status %d, want 403", w.Code)
+	}
+}
+
+func TestImportText(t *testing.T) {
+	s := newTestServer(t)
+	w := s.do("POST", "/todos/import?format=text", "buy milk\n\n  call mom  \r\n\t\nwalk the dog\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("import: status %d: %s", w.Code, w.Body)
+	}
+	var todos []Todo
+	decodeData(t, s.do("GET", "/todo-pending", ""), &todos)
+	var got []string
+	for _, todo := range todos {
+		got = append(got, todo.Description)
+	}
+	if want := []string{"buy milk", "call mom", "walk the dog"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("imported %q, want %q", got, want)
+	}
+}
+
+func TestImportTextInBatches(t *testing.T) {
+	s := newTestServer(t)
+	var lines strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&lines, "todo %d\n", i)
+	}
+	if w := s.do("POST", "/todos/import?format=text", lines.String()); w.Code != http.StatusOK {
+		t.Fatalf("import: status %d: %.200s", w.Code, w.Body)
+	}
+	var count int64
+	s.db.Model(&Todo{}).Count(&count)
+	if count != 5000 {
+		t.Errorf("%d todos stored, want 5000", count)
+	}
+
+	tooMany := strings.Repeat("x\n", maxImportTodos+1)
+	if w := s.do("POST", "/todos/import?format=text", tooMany); w.Code != http.StatusBadRequest {
+		t.Errorf("over %d lines: status %d, want 400", maxImportTodos, w.Code)
+	}
+	s.db.Model(&Todo{}).Count(&count)
+	if count != 5000 {
+		t.Errorf("%d todos stored after the rejected import, want 5000", count)
+	}
+}
+
+func TestImportTextIsAllOrNothing(t *testing.T) {
+	s := newTestServer(t)
+	body := "buy milk\n" + strings.Repeat("x", maxDescriptionLength+1) + "\n"
+	w := s.do("POST", "/todos/import?format=text", body)
+	if w.Code != http.StatusBadRequest || !strings.HasPrefix(w.Body.String(), "line 2: ") {
+		t.Errorf("over-long line: status %d %q, want 400 naming line 2", w.Code, w.Body)
+	}
+	for _, tt := range []struct{ target, body string }{
+		{"/todos/import?format=csv", "buy milk"},
+		{"/todos/import?format=text", "\n \n"},
+	} {
+		if w := s.do("POST", tt.target, tt.body); w.Code != http.StatusBadRequest {
+			t.Errorf("POST %s %q: status %d, want 400", tt.target, tt.body, w.Code)
+		}
+	}
+	var count int64
+	s.db.Model(&Todo{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d todos stored after rejected imports, want 0", count)
+	}
+}
+
+func decodeJSONBody(t *testing.T, body []byte, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(body, v); err != nil {
+		t.Fatalf("decode %s: %v", body, err)
+	}
+}
+
+func TestEmptyListsAreArrays(t *testing.T) {
+	s := newTestServer(t)
+	for _, target := range []string{
+		"/todos",
+		"/todos?idsOnly=true",
+		"/todo-pending",
+		"/todo-completed",
+		"/todos/attention",
+		"/todos/duplicates",
+	} {
+		w := s.do("GET", target, "")
+		var data json.RawMessage
+		decodeData(t, w, &data)
+		if string(data) != "[]" {
+			t.Errorf("GET %s data = %s, want []", target, data)
+		}
+	}
+	if body := s.do("GET", "/todos/export", "").Body.String(); body != "[]\n" {
+		t.Errorf("GET /todos/export = %q, want []", body)
+	}
+}
+
+func TestCompletedBetween(t *testing.T) {
+	s := newTestServer(t)
+	early := s.create("early")
+	inside := s.create("inside")
+	late := s.create("late")
+	s.create("pending")
+	s.complete(early.ID, time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC))
+	s.complete(inside.ID, time.Date(2026, 3, 5, 10, 0, 0, 0, time.UTC))
+	s.complete(late.ID, time.Date(2026, 3, 9, 10, 0, 0, 0, time.UTC))
+
+	for _, window := range []string{
+		"2026-03-02T00:00:00Z,2026-03-06T00:00:00Z",
+		// bounds are inclusive and may carry any offset
+		"2026-03-05T12:00:00+02:00,2026-03-05T05:00:00-05:00",
+	} {
+		var todos []Todo
+		decodeData(t, s.do("GET", "/todos?completedBetween="+url.QueryEscape(window), ""), &todos)
+		if len(todos) != 1 || todos[0].ID != inside.ID {
+			t.Errorf("completedBetween=%s = %+v, want only todo %d", window, todos, inside.ID)
+		}
+	}
+
+	for _, window := range []string{"yesterday", "2026-03-02,2026-03-06", "2026-03-06T00:00:00Z,2026-03-02T00:00:00Z", "2026-03-02T00:00:00Z"} {
+		if w := s.do("GET", "/todos?completedBetween="+url.QueryEscape(window), ""); w.Code != http.StatusBadRequest {
+			t.Errorf("completedBetween=%s: status %d, want 400", window, w.Code)
+		}
+	}
+}
+
+func TestUpdateTouchesOnlyScalarState(t *testing.T) {
+	s := newTestServer(t)
+	r := newRequest("PUT", "/todo", `{"publicId":"client-1","description":"buy milk"}`)
+	r.Header.Set("User-Agent", "todo-cli/1.2")
+	var created Todo
+	decodeData(t, s.serve(r), &created)
+
+	for _, completed := range []bool{true, false} {
+		if w := s.do("POST", fmt.Sprintf("/todo/%d", created.ID), ""); w.Code != http.StatusOK {
+			t.Fatalf("toggle: status %d: %s", w.Code, w.Body)
+		}
+		var stored Todo
+		if err := s.db.First(&stored, created.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if stored.Completed != completed || (stored.CompletedAt != nil) != completed {
+			t.Errorf("after toggle Completed = %v, CompletedAt = %v, want %v", stored.Completed, stored.CompletedAt, completed)
+		}
+		if stored.Description != "buy milk" || *stored.PublicID != "client-1" || stored.UserAgent != "todo-cli/1.2" || !stored.CreatedAt.Equal(created.CreatedAt) {
+			t.Errorf("toggle clobbered other columns: %+v", stored)
+		}
+	}
+
+	// an update racing a delete must not bring the row back
+	todo, err := s.getTodoItem(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.db.Delete(&Todo{}, created.ID)
+	todo.Completed = true
+	if err := s.updateTodoQuery(todo); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	s.db.Unscoped().Model(&Todo{}).Count(&count)
+	if err := s.db.First(&Todo{}, created.ID).Error; count != 1 || err == nil {
+		t.Errorf("update of a deleted todo left %d rows, live lookup error %v", count, err)
+	}
+}
+
+func TestSearchTermIsNormalized(t *testing.T) {
+	tests := []struct {
+		caseFold bool
+		term     string
+		matches  bool
+	}{
+		{true, " Milk ", true},
+		{true, "BUY MILK", true},
+		{true, "%", false},
+		{true, "_", false},
+		{false, " milk ", true},
+		{false, " Milk ", false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("caseFold=%v/%q", tt.caseFold, tt.term), func(t *testing.T) {
+			s := newTestServer(t, func(c *Config) { c.SearchCaseFold = tt.caseFold })
+			s.create("buy milk")
+			match, err := s.findPendingMatchQuery(tt.term)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (match != nil) != tt.matches {
+				t.Errorf("match = %+v, want a match: %v", match, tt.matches)
+			}
+		})
+	}
+}
+
+func TestDeferredTodos(t *testing.T) {
+	s := newTestServer(t)
+	s.create("buy milk")
+	someday := s.create("learn the cello")
+	done := s.create("call mom")
+	s.do("POST", fmt.Sprintf("/todo/%d", done.ID), "")
+
+	if w := s.do("POST", fmt.Sprintf("/todo/%d/defer", someday.ID), ""); w.Code != http.StatusOK {
+		t.Fatalf("defer: status %d: %s", w.Code, w.Body)
+	}
+	if w := s.do("POST", fmt.Sprintf("/todo/%d/defer", done.ID), ""); w.Code != http.StatusConflict {
+		t.Errorf("defer a completed todo: status %d, want 409", w.Code)
+	}
+	descriptions := func(target string) string {
+		t.Helper()
+		var todos []Todo
+		decodeData(t, s.do("GET", target, ""), &todos)
+		var got []string
+		for _, todo := range todos {
+			got = append(got, todo.Description)
+		}
+		return strings.Join(got, ",")
+	}
+	for target, want := range map[string]string{
+		"/todo-pending":           "buy milk",
+		"/todos?status=pending":   "buy milk",
+		"/todos?status=deferred":  "learn the cello",
+		"/todo-completed":         "call mom",
+		"/todos?status=completed": "call mom",
+		"/todos":                  "buy milk,learn the cello,call mom",
+	} {
+		if got := descriptions(target); got != want {
+			t.Errorf("GET %s = %q, want %q", target, got, want)
+		}
+	}
+
+	if w := s.do("POST", fmt.Sprintf("/todo/%d/reactivate", someday.ID), ""); w.Code != http.StatusOK {
+		t.Fatalf("reactivate: status %d: %s", w.Code, w.Body)
+	}
+	if got := descriptions("/todo-pending"); got != "buy milk,learn the cello" {
+		t.Errorf("pending after reactivating = %q", got)
+	}
+}
+
+func TestUpsertClearsDeferred(t *testing.T) {
+	s := newTestServer(t)
+	if w := s.do("PUT", "/todo", `{"publicId":"client-1","description":"learn the cello"}`); w.Code != http.StatusOK {
+		t.Fatalf("upsert insert: status %d: %s", w.Code, w.Body)
+	}
+	var someday Todo
+	s.db.Where("public_id = ?", "client-1").First(&someday)
+	s.do("POST", fmt.Sprintf("/todo/%d/defer", someday.ID), "")
+
+	w := s.do("PUT", "/todo", `{"publicId":"client-1","description":"learn the cello","completed":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("upsert update: status %d: %s", w.Code, w.Body)
+	}
+	var upserted Todo
+	decodeData(t, w, &upserted)
+	if !upserted.Completed || upserted.Deferred {
+		t.Errorf("upserted completed=%v deferred=%v, want completed and not deferred", upserted.Completed, upserted.Deferred)
+	}
+	for target, want := range map[string]int{
+		"/todo-completed":         1,
+		"/todos?status=completed": 1,
+		"/todos?status=deferred":  0,
+	} {
+		var todos []Todo
+		decodeData(t, s.do("GET", target, ""), &todos)
+		if len(todos) != want {
+			t.Errorf("GET %s = %d todos, want %d", target, len(todos), want)
+		}
+	}
+}
+
+func TestPositionHonorsStatusFilter(t *testing.T) {
+	s := newTestServer(t)
+	first := s.create("first")
+	someday := s.create("someday")
+	third := s.create("third")
+	s.do("POST", fmt.Sprintf("/todo/%d/defer", someday.ID), "")
+
+	position := func(target string) (int, int) {
+		t.Helper()
+		w := s.do("GET", target, "")
+		if w.Code != http.StatusOK {
+			return -1, w.Code
+		}
+		var body map[string]int
+		decodeData(t, w, &body)
+		return body["position"], w.Code
+	}
+	tests := []struct {
+		target   string
+		position int
+		status   int
+	}{
+		{fmt.Sprintf("/todo/%d/position?status=pending", third.ID), 1, http.StatusOK},
+		{fmt.Sprintf("/todo/%d/position", third.ID), 2, http.StatusOK},
+		{fmt.Sprintf("/todo/%d/position?status=pending&sort=-id", first.ID), 1, http.StatusOK},
+		{fmt.Sprintf("/todo/%d/position?status=deferred", someday.ID), 0, http.StatusOK},
+		{fmt.Sprintf("/todo/%d/position?status=pending", someday.ID), -1, http.StatusNotFound},
+		{fmt.Sprintf("/todo/%d/position?status=completed", first.ID), -1, http.StatusNotFound},
+		{fmt.Sprintf("/todo/%d/position?status=open", first.ID), -1, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if got, status := position(tt.target); got != tt.position || status != tt.status {
+			t.Errorf("GET %s = %d (status %d), want %d (status %d)", tt.target, got, status, tt.position, tt.status)
+		}
+	}
+}
+
+func TestRestoreTrashedTodos(t *testing.T) {
+	s := newTestServer(t)
+	var trashed []uint
+	for _, description := range []string{"a", "b", "c"} {
+		todo := s.create(description)
+		s.do("DELETE", fmt.Sprintf("/todo/%d", todo.ID), "")
+		trashed = append(trashed, todo.ID)
+	}
+	live := s.create("live")
+
+	body := fmt.Sprintf(`{"ids":[%d,%d,%d,%d,999]}`, trashed[0], trashed[1], trashed[2], live.ID)
+	w := s.do("POST", "/todos/restore", body)
+	var result map[string]int64
+	decodeData(t, w, &result)
+	if result["restored"] != 3 {
+		t.Errorf("restored = %d, want 3", result["restored"])
+	}
+	var todos []Todo
+	decodeData(t, s.do("GET", "/todos", ""), &todos)
+	if len(todos) != 4 {
+		t.Errorf("%d live todos after restoring, want 4", len(todos))
+	}
+	if w := s.do("POST", "/todos/restore", `{"ids":[]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("empty ids: status %d, want 400", w.Code)
+	}
+}
+
+func TestDeleteTwiceIsNotFound(t *testing.T) {
+	s := newTestServer(t)
+	todo := s.create("buy milk")
+	target := fmt.Sprintf("/todo/%d", todo.ID)
+	if w := s.do("DELETE", target, ""); w.Code != http.StatusOK {
+		t.Fatalf("first delete: status %d", w.Code)
+	}
+	w := s.do("DELETE", target, "")
+	if want := fmt.Sprintf("todo %d not found", todo.ID); w.Code != http.StatusNotFound || strings.TrimSpace(w.Body.String()) != want {
+		t.Errorf("second delete: status %d %q, want 404 %q", w.Code, w.Body, want)
+	}
+}
+
+func TestBumpSortsTodoFirst(t *testing.T) {
+	s := newTestServer(t)
+	stale := s.create("stale")
+	s.create("newer")
+	s.create("newest")
+	s.age(stale.ID, 30*24*time.Hour)
+
+	w := s.do("POST", fmt.Sprintf("/todo/%d/bump", stale.ID), "")
+	var bumped Todo
+	decodeData(t, w, &bumped)
+	if bumped.Description != "stale" || bumped.Completed {
+		t.Errorf("bump altered content: %+v", bumped)
+	}
+	var todos []Todo
+	decodeData(t, s.do("GET", "/todos?sort=-createdAt", ""), &todos)
+	if todos[0].ID != stale.ID {
+		t.Errorf("first by -createdAt = %d, want the bumped todo %d", todos[0].ID, stale.ID)
+	}
+	if w := s.do("POST", "/todo/999/bump", ""); w.Code != http.StatusNotFound {
+		t.Errorf("bump unknown id: status %d, want 404", w.Code)
+	}
+}
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+func TestParseWindowUsesLocation(t *testing.T) {
+	tokyo := mustLoadLocation(t, "Asia/Tokyo")
+	// Tuesday 01:30 in Tokyo is still Monday in UTC
+	now := time.Date(2026, 3, 10, 1, 30, 0, 0, tokyo)
+	tests := []struct {
+		window   string
+		from, to time.Time
+	}{
+		{"today", time.Date(2026, 3, 10, 0, 0, 0, 0, tokyo), time.Date(2026, 3, 10, 23, 59, 59, 999999999, tokyo)},
+		{"thisWeek", time.Date(2026, 3, 9, 0, 0, 0, 0, tokyo), time.Date(2026, 3, 15, 23, 59, 59, 999999999, tokyo)},
+	}
+	for _, tt := range tests {
+		from, to, err := parseWindow(tt.window, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !from.Equal(tt.from) || !to.Equal(tt.to) {
+			t.Errorf("%s = %s..%s, want %s..%s", tt.window, from, to, tt.from, tt.to)
+		}
+	}
+}
+
+func TestCompletedTodayHonorsAppTimezone(t *testing.T) {
+	for _, zone := range []string{"Pacific/Kiritimati", "Pacific/Pago_Pago"} {
+		t.Run(zone, func(t *testing.T) {
+			s := newTestServer(t, func(c *Config) { c.AppTZ = zone })
+			year, month, day := time.Now().In(s.location).Date()
+			midnight := time.Date(year, month, day, 0, 0, 0, 0, s.location)
+			today := s.create("today")
+			yesterday := s.create("yesterday")
+			s.complete(today.ID, midnight.UTC())
+			s.complete(yesterday.ID, midnight.Add(-time.Second).UTC())
+
+			var todos []Todo
+			decodeData(t, s.do("GET", "/todos?completedBetween=today", ""), &todos)
+			if len(todos) != 1 || todos[0].ID != today.ID {
+				t.Errorf("completed today = %+v, want only todo %d", todos, today.ID)
+			}
+		})
+	}
+}
+
+func TestResponsesUseAppTimezone(t *testing.T) {
+	s := newTestServer(t, func(c *Config) { c.AppTZ = "Asia/Kolkata" })
+	todo := s.create("buy milk")
+	w := s.do("POST", fmt.Sprintf("/todo/%d", todo.ID), "")
+	var body struct {
+		Data struct {
+			CreatedAt, UpdatedAt, CompletedAt string
+		}
+	}
+	decodeJSONBody(t, w.Body.Bytes(), &body)
+	for name, value := range map[string]string{"CreatedAt": body.Data.CreatedAt, "UpdatedAt": body.Data.UpdatedAt, "CompletedAt": body.Data.CompletedAt} {
+		if !strings.HasSuffix(value, "+05:30") {
+			t.Errorf("%s = %s, want it in +05:30", name, value)
+		}
+	}
+
+	var stored string
+	s.db.Raw("SELECT CAST(completed_at AS TEXT) FROM todos WHERE id = ?", todo.ID).Scan(&stored)
+	if !strings.HasSuffix(stored, "+00:00") {
+		t.Errorf("stored completed_at = %s, want UTC", stored)
+	}
+}
+
+// TestCompletedBetweenAcrossDST queries a window whose bounds sit on either
+// side of a DST change in the server's zone.
+func TestCompletedBetweenAcrossDST(t *testing.T) {
+	local := time.Local
+	time.Local = mustLoadLocation(t, "America/New_York")
+	defer func() { time.Local = local }()
+
+	s := newTestServer(t)
+	times := []time.Time{
+		time.Date(2026, 3, 7, 16, 30, 0, 0, time.UTC),
+		time.Date(2026, 3, 8, 12, 0, 0, 0, time.UTC),
+		time.Date(2026, 3, 9, 15, 30, 0, 0, time.UTC),
+		time.Date(2026, 3, 9, 16, 30, 0, 0, time.UTC),
+	}
+	var ids []uint
+	for i, at := range times {
+		todo := s.create(fmt.Sprintf("todo %d", i))
+		s.complete(todo.ID, at)
+		ids = append(ids, todo.ID)
+	}
+
+	// 12:00 EST on the 7th to 12:00 EDT on the 9th
+	window := url.QueryEscape("2026-03-07T12:00:00-05:00,2026-03-09T12:00:00-04:00")
+	var todos []Todo
+	decodeData(t, s.do("GET", "/todos?completedBetween="+window, ""), &todos)
+	if len(todos) != 2 || todos[0].ID != ids[1] || todos[1].ID != ids[2] {
+		t.Errorf("completed in window = %+v, want todos %d and %d", todos, ids[1], ids[2])
+	}
+}
+
+func TestIDsOnlyMatchesFullList(t *testing.T) {
+	s := newTestServer(t)
+	for i := 0; i < 5; i++ {
+		todo := s.create(fmt.Sprintf("todo %d", i))
+		if i%2 == 1 {
+			s.do("POST", fmt.Sprintf("/todo/%d", todo.ID), "")
+		}
+	}
+	for _, query := range []string{"", "status=pending&sort=-id", "status=completed", "limit=2"} {
+		var todos []Todo
+		decodeData(t, s.do("GET", "/todos?"+query, ""), &todos)
+		want := []uint{}
+		for _, todo := range todos {
+			want = append(want, todo.ID)
+		}
+		var ids []uint
+		decodeData(t, s.do("GET", "/todos?idsOnly=true&"+query, ""), &ids)
+		if fmt.Sprint(ids) != fmt.Sprint(want) {
+			t.Errorf("?%s: ids %v, want %v", query, ids, want)
+		}
+	}
+}
+
+func TestQueriesPassTheModelPointer(t *testing.T) {
+	s := newTestServer(t)
+	dests := map[string]string{}
+	record := func(op string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			if tx.Statement.Schema != nil && tx.Statement.Schema.Name == "Todo" {
+				dests[op] = fmt.Sprintf("%T", tx.Statement.Dest)
+			}
+		}
+	}
+	s.db.Callback().Create().Before("gorm:create").Register("test:create", record("create"))
+	s.db.Callback().Delete().Before("gorm:delete").Register("test:delete", record("delete"))
+
+	todo := s.create("hooked")
+	if todo.ID == 0 {
+		t.Fatal("create did not populate the id")
+	}
+	if w := s.do("DELETE", fmt.Sprintf("/todo/%d", todo.ID), ""); w.Code != http.StatusOK {
+		t.Fatalf("delete status %d", w.Code)
+	}
+	for _, op := range []string{"create", "delete"} {
+		if dests[op] != "*main.Todo" {
+			t.Errorf("%s received %q, want *main.Todo", op, dests[op])
+		}
+	}
+}
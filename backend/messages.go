@@ -0,0 +1,40 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const defaultLanguage = "en"
+
+// messages.json maps a language to the validation messages keyed by
+// "<field>.<rule>"
+//
+//go:embed messages.json
+var messagesFile []byte
+
+var messages map[string]map[string]string
+
+func init() {
+	if err := json.Unmarshal(messagesFile, &messages); err != nil {
+		panic(err)
+	}
+}
+
+// message returns the text for key in the first language of the request's
+// Accept-Language header that defines it, falling back to English.
+func message(r *http.Request, key string) string {
+	for _, lang := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		lang, _, _ = strings.Cut(lang, ";")
+		lang, _, _ = strings.Cut(strings.TrimSpace(lang), "-")
+		if text, ok := messages[strings.ToLower(lang)][key]; ok {
+			return text
+		}
+	}
+	if text, ok := messages[defaultLanguage][key]; ok {
+		return text
+	}
+	return key
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidationMessageLanguage(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"", "description is required"},
+		{"fr-CH, fr;q=0.9, en;q=0.8", "la description est obligatoire"},
+		{"es", "la descripción es obligatoria"},
+		{"nl, de;q=0.5", "Beschreibung ist erforderlich"},
+		{"nl", "description is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.acceptLanguage, func(t *testing.T) {
+			r := newRequest("PUT", "/todo", `{"description":"  "}`)
+			r.Header.Set("Accept-Language", tt.acceptLanguage)
+			w := s.serve(r)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400", w.Code)
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tt.want {
+				t.Errorf("message = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDescriptionLengthCountsCharacters(t *testing.T) {
+	s := newTestServer(t)
+	if w := s.do("PUT", "/todo", jsonBody(t, TodoCreateRequest{Description: strings.Repeat("é", maxDescriptionLength)})); w.Code != http.StatusOK {
+		t.Errorf("%d two-byte characters: status %d: %s", maxDescriptionLength, w.Code, w.Body)
+	}
+	r := newRequest("PUT", "/todo", jsonBody(t, TodoCreateRequest{Description: strings.Repeat("é", maxDescriptionLength+1)}))
+	r.Header.Set("Accept-Language", "de")
+	w := s.serve(r)
+	if got, want := strings.TrimSpace(w.Body.String()), messages["de"]["description.tooLong"]; w.Code != http.StatusBadRequest || got != want {
+		t.Errorf("%d characters: status %d %q, want 400 %q", maxDescriptionLength+1, w.Code, got, want)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+const maxPageSize = 1000
+
+var errInvalidPageToken = errors.New("invalid page token")
+
+// pageState is what a page token carries: the query the listing was made
+// with (filters and sort) and the window of the next page.
+type pageState struct {
+	Query  url.Values `json:"q"`
+	Offset int        `json:"o"`
+	Limit  int        `json:"l"`
+}
+
+// encodePageToken serializes the state as base64 JSON followed by an HMAC of
+// it, so clients can't alter the filters or offset.
+func (t *TodoServer) encodePageToken(state pageState) (string, error) {
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + t.signPageToken(encoded), nil
+}
+
+func (t *TodoServer) decodePageToken(token string) (pageState, error) {
+	var state pageState
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(t.signPageToken(encoded))) {
+		return state, errInvalidPageToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return state, errInvalidPageToken
+	}
+	if err := json.Unmarshal(payload, &state); err != nil {
+		return state, errInvalidPageToken
+	}
+	return state, nil
+}
+
+func (t *TodoServer) signPageToken(encoded string) string {
+	mac := hmac.New(sha256.New, t.pageTokenSecret)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
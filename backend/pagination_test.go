@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPageTokenRoundTrip(t *testing.T) {
+	s := newTestServer(t)
+	state := pageState{Query: url.Values{"status": {"pending"}, "sort": {"-createdAt"}}, Offset: 20, Limit: 10}
+	token, err := s.encodePageToken(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := s.decodePageToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, state) {
+		t.Errorf("decoded %+v, want %+v", decoded, state)
+	}
+}
+
+func TestPageTokenRejectsTampering(t *testing.T) {
+	s := newTestServer(t)
+	token, err := s.encodePageToken(pageState{Query: url.Values{"status": {"pending"}}, Offset: 2, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, signature, _ := strings.Cut(token, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(encoded)
+	forged := base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(payload), "pending", "completed", 1)))
+	other := newTestServer(t, func(c *Config) { c.PageTokenSecret = "another secret" })
+	otherToken, _ := other.encodePageToken(pageState{Offset: 2, Limit: 2})
+
+	for name, tampered := range map[string]string{
+		"altered payload":   forged + "." + signature,
+		"altered signature": encoded + "." + strings.ToUpper(signature),
+		"no signature":      encoded,
+		"other secret":      otherToken,
+		"garbage":           "not a token",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := s.decodePageToken(tampered); err != errInvalidPageToken {
+				t.Errorf("error = %v, want %v", err, errInvalidPageToken)
+			}
+			w := s.do("GET", "/todos?pageToken="+url.QueryEscape(tampered), "")
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("GET /todos: status %d, want 400", w.Code)
+			}
+		})
+	}
+}
+
+func TestPagingFollowsNextToken(t *testing.T) {
+	s := newTestServer(t)
+	for i := 1; i <= 5; i++ {
+		todo := s.create(fmt.Sprintf("todo %d", i))
+		if i%2 == 0 {
+			s.do("POST", fmt.Sprintf("/todo/%d", todo.ID), "")
+		}
+	}
+
+	var got []string
+	target := "/todos?status=pending&sort=-id&limit=2"
+	for pages := 0; target != ""; pages++ {
+		if pages > 3 {
+			t.Fatal("paging did not end")
+		}
+		w := s.do("GET", target, "")
+		var todos []Todo
+		decodeData(t, w, &todos)
+		for _, todo := range todos {
+			got = append(got, todo.Description)
+		}
+		target = ""
+		if token := w.Header().Get("X-Next-Token"); token != "" {
+			// the token alone carries the filters, sort and page size
+			target = "/todos?pageToken=" + url.QueryEscape(token)
+		}
+	}
+	if want := "todo 5,todo 3,todo 1"; strings.Join(got, ",") != want {
+		t.Errorf("pages = %q, want %q", got, want)
+	}
+
+	for _, limit := range []string{"0", "-1", "abc", fmt.Sprint(maxPageSize + 1)} {
+		if w := s.do("GET", "/todos?limit="+limit, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("limit=%s: status %d, want 400", limit, w.Code)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// workQueue bounds the number of requests hitting the database. At most
+// cap(workers) requests run at once, up to cap(admitted) are accepted in
+// total and anything beyond that is shed with 503.
+type workQueue struct {
+	admitted chan struct{}
+	workers  chan struct{}
+
+	mu        sync.Mutex
+	depth     int
+	waitSum   time.Duration
+	waitCount int
+	shed      int
+}
+
+func newWorkQueue(workers, capacity int) *workQueue {
+	return &workQueue{
+		admitted: make(chan struct{}, workers+capacity),
+		workers:  make(chan struct{}, workers),
+	}
+}
+
+func (q *workQueue) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case q.admitted <- struct{}{}:
+		default:
+			q.mu.Lock()
+			q.shed++
+			q.mu.Unlock()
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusServiceUnavailable, "server is busy, retry later")
+			return
+		}
+		defer func() { <-q.admitted }()
+
+		start := time.Now()
+		q.mu.Lock()
+		q.depth++
+		q.mu.Unlock()
+		// a client that goes away while queued gives up its place. The
+		// request still ends in a failure status, so it isn't tracked as a
+		// success by the error rate.
+		select {
+		case q.workers <- struct{}{}:
+		case <-r.Context().Done():
+			q.mu.Lock()
+			q.depth--
+			q.mu.Unlock()
+			writeError(w, r, http.StatusServiceUnavailable, "request cancelled while waiting for a database worker")
+			return
+		}
+		q.mu.Lock()
+		q.depth--
+		q.waitSum += time.Since(start)
+		q.waitCount++
+		q.mu.Unlock()
+		defer func() { <-q.workers }()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// getMetrics exposes the queue metrics in the Prometheus text format.
+func (t *TodoServer) getMetrics(w http.ResponseWriter, r *http.Request) {
+	q := t.queue
+	q.mu.Lock()
+	depth, waitSum, waitCount, shed := q.depth, q.waitSum, q.waitCount, q.shed
+	q.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP queue_depth Requests waiting for a database worker.")
+	fmt.Fprintln(w, "# TYPE queue_depth gauge")
+	fmt.Fprintf(w, "queue_depth %d\n", depth)
+	fmt.Fprintln(w, "# HELP queue_wait_seconds Time requests spent waiting for a database worker.")
+	fmt.Fprintln(w, "# TYPE queue_wait_seconds summary")
+	fmt.Fprintf(w, "queue_wait_seconds_sum %f\n", waitSum.Seconds())
+	fmt.Fprintf(w, "queue_wait_seconds_count %d\n", waitCount)
+	fmt.Fprintln(w, "# HELP queue_shed_total Requests rejected because the queue was full.")
+	fmt.Fprintln(w, "# TYPE queue_shed_total counter")
+	fmt.Fprintf(w, "queue_shed_total %d\n", shed)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingQueue returns a queue with one worker and room for one waiting
+// request, wrapped around a handler that holds its worker until release is
+// closed.
+func blockingQueue() (q *workQueue, handler http.Handler, started chan struct{}, release chan struct{}) {
+	q = newWorkQueue(1, 1)
+	started = make(chan struct{}, 10)
+	release = make(chan struct{})
+	handler = q.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	return q, handler, started, release
+}
+
+// serveAsync serves r in the background and closes the returned channel
+// once the handler has returned.
+func serveAsync(handler http.Handler, r *http.Request) (*httptest.ResponseRecorder, chan struct{}) {
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(w, r)
+	}()
+	return w, done
+}
+
+// metric reads a sample from the /metrics output.
+func metric(t *testing.T, q *workQueue, name string) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	(&TodoServer{queue: q}).getMetrics(w, newRequest("GET", "/metrics", ""))
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), name+" "); ok {
+			return value
+		}
+	}
+	t.Fatalf("metric %s missing from %s", name, w.Body)
+	return ""
+}
+
+func waitForMetric(t *testing.T, q *workQueue, name, want string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for metric(t, q, name) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s = %s, want %s", name, metric(t, q, name), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorkQueueDepthAndShedding(t *testing.T) {
+	q, handler, started, release := blockingQueue()
+
+	_, first := serveAsync(handler, newRequest("GET", "/", ""))
+	<-started
+	_, second := serveAsync(handler, newRequest("GET", "/", ""))
+	waitForMetric(t, q, "queue_depth", "1")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest("GET", "/", ""))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("request over capacity: status %d, Retry-After %q, want 503 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+	if got := metric(t, q, "queue_shed_total"); got != "1" {
+		t.Errorf("queue_shed_total = %s, want 1", got)
+	}
+
+	close(release)
+	<-first
+	<-second
+	if got := metric(t, q, "queue_depth"); got != "0" {
+		t.Errorf("queue_depth after draining = %s, want 0", got)
+	}
+	if got := metric(t, q, "queue_wait_seconds_count"); got != "2" {
+		t.Errorf("queue_wait_seconds_count = %s, want 2", got)
+	}
+}
+
+func TestWorkQueueReleasesCancelledRequests(t *testing.T) {
+	q, handler, started, release := blockingQueue()
+	defer close(release)
+
+	serveAsync(handler, newRequest("GET", "/", ""))
+	<-started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelledW, cancelled := serveAsync(handler, newRequest("GET", "/", "").WithContext(ctx))
+	waitForMetric(t, q, "queue_depth", "1")
+
+	cancel()
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("cancelled request is still waiting for a worker")
+	}
+	if got := metric(t, q, "queue_depth"); got != "0" {
+		t.Errorf("queue_depth after cancelling = %s, want 0", got)
+	}
+	if cancelledW.Code != http.StatusServiceUnavailable {
+		t.Errorf("cancelled request status = %d, want 503", cancelledW.Code)
+	}
+
+	// the cancelled request's admission slot is free again, so the next
+	// request queues instead of being shed
+	serveAsync(handler, newRequest("GET", "/", ""))
+	waitForMetric(t, q, "queue_depth", "1")
+	if got := metric(t, q, "queue_shed_total"); got != "0" {
+		t.Errorf("queue_shed_total = %s, want 0", got)
+	}
+}
+
+func TestCancelledQueuedRequestsCountAsFailures(t *testing.T) {
+	s := newTestServer(t)
+	s.queue = newWorkQueue(1, 1)
+	s.handler = s.routes()
+	s.queue.workers <- struct{}{}
+	defer func() { <-s.queue.workers }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.serve(newRequest("GET", "/todos", "").WithContext(ctx))
+	if rate, requests := s.errorRate.rate(); requests != 1 || rate != 1 {
+		t.Errorf("error rate = %v over %d requests, want 1 over 1", rate, requests)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+)
+
+var errEmptyBody = errors.New("request body is required")
+
+// decodeJSON decodes the request body into v after checking it against the
+// configured size, nesting depth and token count, so oversized or deeply
+// nested payloads are rejected before they are materialized.
+func (t *TodoServer) decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	return decodeJSONWithin(w, r, v, t.maxBodyBytes, t.maxJSONDepth, t.maxJSONTokens)
+}
+
+func decodeJSONWithin(w http.ResponseWriter, r *http.Request, v interface{}, maxBytes int64, maxDepth, maxTokens int) error {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBytes))
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return errEmptyBody
+	}
+	if err := checkJSONLimits(body, maxDepth, maxTokens); err != nil {
+		return err
+	}
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(v)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && len(typeErr.Field) > 0 {
+		return fmt.Errorf("%s must be %s", typeErr.Field, jsonTypeName(typeErr.Type.Kind()))
+	}
+	return err
+}
+
+// bodyErrorStatus is the status for a request body that failed to read or
+// decode: 413 when it ran past its size limit, 400 otherwise.
+func bodyErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// jsonTypeName describes the JSON value expected for a Go kind.
+func jsonTypeName(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.String:
+		return "a string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+func checkJSONLimits(body []byte, maxDepth, maxTokens int) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	depth, tokens := 0, 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			// syntax errors are reported by the real decode
+			return nil
+		}
+		tokens++
+		if tokens > maxTokens {
+			return fmt.Errorf("json payload exceeds %d tokens", maxTokens)
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			if depth > maxDepth {
+				return fmt.Errorf("json payload exceeds nesting depth of %d", maxDepth)
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
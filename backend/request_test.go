@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDecodeJSONRejectsDeepNesting(t *testing.T) {
+	s := newTestServer(t)
+	body := `{"description":"x","nested":` + strings.Repeat("[", 100) + strings.Repeat("]", 100) + `}`
+	w := s.do("PUT", "/todo", body)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "nesting depth of 20") {
+		t.Errorf("status %d %q, want 400 for exceeding the nesting depth", w.Code, w.Body)
+	}
+}
+
+func TestDecodeJSONLimitsAreConfigurable(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.MaxJSONDepth = 2
+		c.MaxJSONTokens = 8
+	})
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"within limits", `{"description":"x","tags":["a"]}`, http.StatusOK},
+		{"too deep", `{"description":"x","tags":[["a"]]}`, http.StatusBadRequest},
+		{"too many tokens", `{"description":"x","tags":["a","b","c","d"]}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := s.do("PUT", "/todo", tt.body); w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestEmptyBodyIsRejected(t *testing.T) {
+	s := newTestServer(t)
+	for _, body := range []string{"", " \n\t"} {
+		w := s.do("PUT", "/todo", body)
+		if w.Code != http.StatusBadRequest || strings.TrimSpace(w.Body.String()) != errEmptyBody.Error() {
+			t.Errorf("body %q: status %d %q, want 400 %q", body, w.Code, w.Body, errEmptyBody)
+		}
+	}
+}
+
+func TestTypeErrorsNameTheField(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"description":"buy milk","completed":"yes"}`, "completed must be a boolean"},
+		{`{"description":42}`, "description must be a string"},
+	}
+	for _, tt := range tests {
+		w := s.do("PUT", "/todo", tt.body)
+		if got := strings.TrimSpace(w.Body.String()); w.Code != http.StatusBadRequest || got != tt.want {
+			t.Errorf("%s: status %d %q, want 400 %q", tt.body, w.Code, got, tt.want)
+		}
+	}
+	if w := s.do("POST", "/todos/merge", `{"sourceId":"1","targetId":2}`); !strings.Contains(w.Body.String(), "sourceId must be an integer") {
+		t.Errorf("merge with a string id: %q, want the field named", w.Body)
+	}
+
+	w := s.do("PUT", "/todo", `{"description":"buy milk","completed":true}`)
+	var todo Todo
+	decodeData(t, w, &todo)
+	if !todo.Completed || todo.CompletedAt == nil {
+		t.Errorf("completed create = %+v, want Completed with CompletedAt", todo)
+	}
+}
+
+func TestRequestBodiesAreSizeLimited(t *testing.T) {
+	s := newTestServer(t, func(c *Config) { c.MaxBodyBytes = 64 })
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+	}{
+		{"json", "PUT", "/todo", `{"description":"` + strings.Repeat("x", 100) + `"}`},
+		{"text import", "POST", "/todos/import?format=text", strings.Repeat("x", 100)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := s.do(tt.method, tt.target, tt.body); w.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("status = %d, want 413: %s", w.Code, w.Body)
+			}
+		})
+	}
+	var count int64
+	s.db.Model(&Todo{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d todos stored from oversized bodies", count)
+	}
+	if w := s.do("PUT", "/todo", `{"description":"fits"}`); w.Code != http.StatusOK {
+		t.Errorf("body within the limit: status %d: %s", w.Code, w.Body)
+	}
+}
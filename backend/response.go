@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const latestAPIVersion = 2
+
+// apiVersions maps each supported version to how it shapes a response body.
+// v1 returns the value bare; v2 wraps it in a {"data": ...} envelope.
+var apiVersions = map[int]func(v interface{}) interface{}{
+	1: func(v interface{}) interface{} { return v },
+	2: func(v interface{}) interface{} { return Envelope{Data: v} },
+}
+
+var vendorMediaType = regexp.MustCompile(`application/vnd\.todo\.v(\d+)\+json`)
+
+// Envelope is the v2 response body.
+type Envelope struct {
+	Data interface{} `json:"data"`
+}
+
+// apiVersion reads the version from an Accept header such as
+// application/vnd.todo.v1+json, defaulting to the latest version.
+func apiVersion(r *http.Request) (int, error) {
+	match := vendorMediaType.FindStringSubmatch(r.Header.Get("Accept"))
+	if match == nil {
+		return latestAPIVersion, nil
+	}
+	version, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0, fmt.Errorf("unsupported api version: %s", match[1])
+	}
+	if _, ok := apiVersions[version]; !ok {
+		return 0, fmt.Errorf("unsupported api version: %d", version)
+	}
+	return version, nil
+}
+
+type apiVersionKey struct{}
+
+// negotiateVersion rejects an unsupported API version with 406 before the
+// handler runs, so a request that can't be answered changes nothing. The
+// version is passed on to writeJSON in the request context.
+func negotiateVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version, err := apiVersion(r)
+		if err != nil {
+			writeError(w, r, http.StatusNotAcceptable, err.Error())
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version)))
+	})
+}
+
+// writeJSON encodes v in the shape of the API version the client negotiated,
+// or the latest version for requests that didn't go through negotiateVersion.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	version, ok := r.Context().Value(apiVersionKey{}).(int)
+	if !ok {
+		version = latestAPIVersion
+	}
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("X-API-Version", strconv.Itoa(version))
+	writeRawJSON(w, r, status, apiVersions[version](v))
+}
+
+// writeRawJSON encodes v as the response body without any version envelope.
+// Output is compact unless the client asks for indentation with ?pretty=true
+// or an X-Pretty header.
+func writeRawJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	var body []byte
+	var err error
+	if wantsPretty(r) {
+		body, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		body, err = json.Marshal(v)
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
+
+func wantsPretty(r *http.Request) bool {
+	value := r.URL.Query().Get("pretty")
+	if len(value) == 0 {
+		value = r.Header.Get("X-Pretty")
+	}
+	pretty, _ := strconv.ParseBool(value)
+	return pretty
+}
+
+// Problem is an RFC 7807 problem details body.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail"`
+	Instance string `json:"instance"`
+}
+
+// writeError replies with a plain text error, or with problem+json when the
+// client accepts application/problem+json.
+func writeError(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	if !strings.Contains(r.Header.Get("Accept"), "application/problem+json") {
+		http.Error(w, detail, status)
+		return
+	}
+	body, _ := json.Marshal(Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.RequestURI(),
+	})
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
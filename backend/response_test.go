@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrettyJSON(t *testing.T) {
+	s := newTestServer(t)
+	s.create("buy milk")
+
+	compact := s.do("GET", "/todos", "").Body.String()
+	if strings.Count(compact, "\n") != 1 || strings.Contains(compact, "  ") {
+		t.Errorf("default response is not compact: %s", compact)
+	}
+
+	byHeader := newRequest("GET", "/todos", "")
+	byHeader.Header.Set("X-Pretty", "true")
+	for name, w := range map[string]string{
+		"?pretty=true": s.do("GET", "/todos?pretty=true", "").Body.String(),
+		"X-Pretty":     s.serve(byHeader).Body.String(),
+	} {
+		if !strings.Contains(w, "\n  \"data\": [\n    {\n      \"ID\": 1,") {
+			t.Errorf("%s response is not indented: %s", name, w)
+		}
+	}
+}
+
+func TestProblemJSON(t *testing.T) {
+	s := newTestServer(t)
+
+	plain := s.do("DELETE", "/todo/42", "")
+	if plain.Code != http.StatusNotFound || !strings.HasPrefix(plain.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("default error: status %d, Content-Type %q, want a plain text 404", plain.Code, plain.Header().Get("Content-Type"))
+	}
+
+	r := newRequest("DELETE", "/todo/42?force=1", "")
+	r.Header.Set("Accept", "application/json, application/problem+json")
+	w := s.serve(r)
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/problem+json" {
+		t.Errorf("Content-Type = %q, want application/problem+json", contentType)
+	}
+	var problem Problem
+	decodeJSONBody(t, w.Body.Bytes(), &problem)
+	want := Problem{
+		Type:     "about:blank",
+		Title:    "Not Found",
+		Status:   http.StatusNotFound,
+		Detail:   "todo 42 not found",
+		Instance: "/todo/42?force=1",
+	}
+	if problem != want {
+		t.Errorf("problem = %+v, want %+v", problem, want)
+	}
+}
+
+func TestAPIVersions(t *testing.T) {
+	s := newTestServer(t)
+	s.create("buy milk")
+
+	get := func(accept string) *httptest.ResponseRecorder {
+		r := newRequest("GET", "/todos", "")
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		return s.serve(r)
+	}
+
+	v1 := get("application/vnd.todo.v1+json")
+	var bare []Todo
+	decodeJSONBody(t, v1.Body.Bytes(), &bare)
+	if len(bare) != 1 || bare[0].Description != "buy milk" {
+		t.Errorf("v1 body = %s, want a bare array", v1.Body)
+	}
+	if version := v1.Header().Get("X-API-Version"); version != "1" {
+		t.Errorf("v1 X-API-Version = %q", version)
+	}
+
+	for name, accept := range map[string]string{"v2": "application/vnd.todo.v2+json", "default": ""} {
+		w := get(accept)
+		var envelope struct {
+			Data []Todo `json:"data"`
+		}
+		decodeJSONBody(t, w.Body.Bytes(), &envelope)
+		if len(envelope.Data) != 1 || envelope.Data[0].Description != "buy milk" {
+			t.Errorf("%s body = %s, want the todos under data", name, w.Body)
+		}
+		if version := w.Header().Get("X-API-Version"); version != "2" {
+			t.Errorf("%s X-API-Version = %q", name, version)
+		}
+		if vary := w.Header().Get("Vary"); vary != "Accept" {
+			t.Errorf("%s Vary = %q, want Accept", name, vary)
+		}
+	}
+
+	if w := get("application/vnd.todo.v9+json"); w.Code != http.StatusNotAcceptable {
+		t.Errorf("v9 status %d, want 406", w.Code)
+	}
+}
+
+func TestUnsupportedVersionIsRejectedBeforeWriting(t *testing.T) {
+	s := newTestServer(t)
+	r := newRequest("PUT", "/todo", `{"description":"buy milk"}`)
+	r.Header.Set("Accept", "application/vnd.todo.v9+json")
+	if w := s.serve(r); w.Code != http.StatusNotAcceptable {
+		t.Errorf("v9 PUT /todo: status %d, want 406", w.Code)
+	}
+	var count int64
+	s.db.Model(&Todo{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d todos stored by a rejected request, want 0", count)
+	}
+}
+
+func TestExportStaysBare(t *testing.T) {
+	s := newTestServer(t)
+	s.create("buy milk")
+	for _, accept := range []string{"", "application/vnd.todo.v1+json", "application/vnd.todo.v2+json"} {
+		r := newRequest("GET", "/todos/export", "")
+		r.Header.Set("Accept", accept)
+		w := s.serve(r)
+		var todos []Todo
+		if err := json.Unmarshal(w.Body.Bytes(), &todos); err != nil || len(todos) != 1 {
+			t.Errorf("Accept %q: export body = %s, want a bare array", accept, w.Body)
+		}
+	}
+}